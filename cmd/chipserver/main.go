@@ -14,7 +14,11 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/nyaruka/chip"
 	"github.com/nyaruka/chip/core/courier"
+	"github.com/nyaruka/chip/core/mailer"
+	"github.com/nyaruka/chip/core/storage"
 	"github.com/nyaruka/chip/runtime"
+	"github.com/nyaruka/gocommon/aws/cwatch"
+	"github.com/nyaruka/gocommon/aws/s3x"
 	"github.com/nyaruka/vkutil"
 	slogmulti "github.com/samber/slog-multi"
 	slogsentry "github.com/samber/slog-sentry/v2"
@@ -81,7 +85,36 @@ func newService(cfg *runtime.Config, log *slog.Logger) (*chip.Service, error) {
 		log.Info("valkey ok")
 	}
 
-	svc := chip.NewService(rt, courier.NewCourier(rt.Config))
+	rt.CW, err = cwatch.NewService(rt.Config.AWSAccessKeyID, rt.Config.AWSSecretAccessKey, rt.Config.AWSRegion, rt.Config.CloudwatchNamespace, rt.Config.DeploymentID)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cloudwatch service: %w", err)
+	} else {
+		log.Info("cloudwatch ok")
+	}
+
+	mail, err := mailer.NewMailer(rt.Config.SMTPServer)
+	if err != nil {
+		return nil, fmt.Errorf("error creating mailer: %w", err)
+	}
+
+	var attachments storage.Storage
+	if rt.Config.S3AttachmentsBucket != "" {
+		s3, err := s3x.NewService(rt.Config.AWSAccessKeyID, rt.Config.AWSSecretAccessKey, rt.Config.AWSRegion, rt.Config.S3Endpoint, rt.Config.S3Minio)
+		if err != nil {
+			return nil, fmt.Errorf("error creating S3 service: %w", err)
+		}
+		attachments = storage.NewS3(s3, rt.Config.S3AttachmentsBucket)
+	} else {
+		proto := "http"
+		if rt.Config.SSL {
+			proto += "s"
+		}
+		attachments = storage.NewFS(rt.Config.AttachmentsDir, fmt.Sprintf("%s://%s/wc/", proto, rt.Config.Domain))
+	}
+
+	log.Info("attachments storage ok", "type", attachments.Name())
+
+	svc := chip.NewService(rt, courier.NewCourier(rt.Config), mail, attachments)
 	if err := svc.Start(); err != nil {
 		return nil, err
 	}
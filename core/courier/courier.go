@@ -3,22 +3,27 @@ package courier
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/nyaruka/chip/core/models"
 	"github.com/nyaruka/chip/runtime"
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/jsonx"
 )
 
 // Courier is the interface for interacting with a courier instance or a mock
 type Courier interface {
-	StartChat(context.Context, *models.Channel, models.ChatID) error
-	CreateMsg(context.Context, *models.Channel, *models.Contact, string) error
-	ReportDelivered(context.Context, *models.Channel, *models.Contact, models.MsgID) error
+	StartChat(context.Context, *models.Channel, models.ChatID, *models.Identity) error
+	CreateMsg(context.Context, *models.Channel, *models.Contact, string, []string, models.MsgID, MsgFlags) (*models.MsgIn, error)
+	ReportStatus(context.Context, *models.Channel, *models.Contact, []models.MsgID, MsgStatus) error
+	ReportTyping(context.Context, *models.Channel, *models.Contact) error
+	UpdateContact(context.Context, *models.Channel, *models.Contact, *models.ContactUpdate) error
 }
 
 type courier struct {
@@ -36,7 +41,16 @@ type payload struct {
 	Events []Event       `json:"events"`
 }
 
-func (c *courier) request(ctx context.Context, ch *models.Channel, payload *payload) error {
+// response from courier which includes details of anything it created, e.g. messages
+type response struct {
+	Data []struct {
+		Type       string         `json:"type"`
+		MsgUUID    models.MsgUUID `json:"msg_uuid"`
+		ReceivedOn time.Time      `json:"received_on"`
+	} `json:"data"`
+}
+
+func (c *courier) request(ctx context.Context, ch *models.Channel, payload *payload) ([]byte, error) {
 	proto := "http"
 	if c.cfg.SSL {
 		proto += "s"
@@ -45,37 +59,92 @@ func (c *courier) request(ctx context.Context, ch *models.Channel, payload *payl
 	body := jsonx.MustMarshal(payload)
 	request, _ := httpx.NewRequest(ctx, "POST", url, bytes.NewReader(body), map[string]string{"Content-Type": "application/json"})
 
-	resp, err := httpx.Do(http.DefaultClient, request, nil, nil)
+	trace, err := httpx.DoTrace(http.DefaultClient, request, nil, nil, -1)
 	if err != nil {
-		return fmt.Errorf("error connecting courier: %w", err)
-	} else if resp.StatusCode/100 != 2 {
-		return errors.New("courier returned non-2XX status")
+		return nil, fmt.Errorf("error connecting courier: %w", err)
+	} else if trace.Response.StatusCode/100 != 2 {
+		return nil, errors.New("courier returned non-2XX status")
 	}
 
-	slog.Debug("courier notified", "event", body, "status", resp.StatusCode)
-	return nil
+	slog.Debug("courier notified", "event", body, "status", trace.Response.StatusCode)
+	return trace.ResponseBody, nil
 }
 
-func (c *courier) StartChat(ctx context.Context, ch *models.Channel, chatID models.ChatID) error {
-	return c.request(ctx, ch, &payload{
+func (c *courier) StartChat(ctx context.Context, ch *models.Channel, chatID models.ChatID, identity *models.Identity) error {
+	_, err := c.request(ctx, ch, &payload{
 		ChatID: chatID,
 		Secret: ch.Secret(),
-		Events: []Event{newChatStartedEvent()},
+		Events: []Event{newChatStartedEvent(identity)},
+	})
+	return err
+}
+
+// CreateMsg creates a new incoming message, optionally in reply to an outgoing message, e.g. by tapping one of its quick
+// replies, and returns it with the UUID and time assigned by courier. Once courier has accepted the message it has been
+// created, so if its response can't be understood, the message is returned without a UUID rather than as an error which
+// would let the client send it again.
+func (c *courier) CreateMsg(ctx context.Context, ch *models.Channel, contact *models.Contact, text string, attachments []string, replyTo models.MsgID, flags MsgFlags) (*models.MsgIn, error) {
+	body, err := c.request(ctx, ch, &payload{
+		ChatID: contact.ChatID,
+		Secret: ch.Secret(),
+		Events: []Event{newMsgInEvent(text, attachments, replyTo, flags)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msgIn := &models.MsgIn{Text: text, Attachments: attachments, Time: dates.Now(), ReplyTo: replyTo}
+
+	resp := &response{}
+	if err := json.Unmarshal(body, resp); err != nil {
+		slog.Error("error parsing courier response", "error", err, "body", string(body))
+		return msgIn, nil
+	}
+
+	for _, d := range resp.Data {
+		if d.Type == "msg" {
+			msgIn.UUID = d.MsgUUID
+			if !d.ReceivedOn.IsZero() {
+				msgIn.Time = d.ReceivedOn
+			}
+			return msgIn, nil
+		}
+	}
+
+	slog.Error("courier response doesn't include created message", "body", string(body))
+	return msgIn, nil
+}
+
+// ReportStatus reports the same status for each of the given messages, in a single request
+func (c *courier) ReportStatus(ctx context.Context, ch *models.Channel, contact *models.Contact, msgIDs []models.MsgID, status MsgStatus) error {
+	events := make([]Event, len(msgIDs))
+	for i, msgID := range msgIDs {
+		events[i] = newMsgStatusEvent(msgID, status)
+	}
+
+	_, err := c.request(ctx, ch, &payload{
+		ChatID: contact.ChatID,
+		Secret: ch.Secret(),
+		Events: events,
 	})
+	return err
 }
 
-func (c *courier) CreateMsg(ctx context.Context, ch *models.Channel, contact *models.Contact, text string) error {
-	return c.request(ctx, ch, &payload{
+func (c *courier) ReportTyping(ctx context.Context, ch *models.Channel, contact *models.Contact) error {
+	_, err := c.request(ctx, ch, &payload{
 		ChatID: contact.ChatID,
 		Secret: ch.Secret(),
-		Events: []Event{newMsgInEvent(text)},
+		Events: []Event{newTypingEvent()},
 	})
+	return err
 }
 
-func (c *courier) ReportDelivered(ctx context.Context, ch *models.Channel, contact *models.Contact, msgID models.MsgID) error {
-	return c.request(ctx, ch, &payload{
+// UpdateContact asks courier to update the name, language or fields of a contact
+func (c *courier) UpdateContact(ctx context.Context, ch *models.Channel, contact *models.Contact, update *models.ContactUpdate) error {
+	_, err := c.request(ctx, ch, &payload{
 		ChatID: contact.ChatID,
 		Secret: ch.Secret(),
-		Events: []Event{newMsgStatusEvent(msgID, MsgStatusDelivered)},
+		Events: []Event{newContactUpdateEvent(update)},
 	})
+	return err
 }
@@ -4,11 +4,13 @@ import (
 	"io"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/chip/core/courier"
 	"github.com/nyaruka/chip/core/models"
 	"github.com/nyaruka/chip/runtime"
 	"github.com/nyaruka/chip/testsuite"
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -18,14 +20,23 @@ func TestCourier(t *testing.T) {
 	ctx, rt := testsuite.Runtime()
 
 	defer testsuite.ResetDB()
+	defer dates.SetNowFunc(time.Now)
+
+	dates.SetNowFunc(dates.NewFixedNow(time.Date(2024, 5, 2, 16, 5, 4, 0, time.UTC)))
 
 	defer httpx.SetRequestor(httpx.DefaultRequestor)
 	mocks := httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
 		"http://example.com/c/chp/8291264a-4581-4d12-96e5-e9fcfa6e68d9/receive": {
+			httpx.NewMockResponse(200, nil, nil),
+			httpx.NewMockResponse(200, nil, []byte(`{"message":"Message Accepted","data":[{"type":"msg","channel_uuid":"8291264a-4581-4d12-96e5-e9fcfa6e68d9","msg_uuid":"0191a4e4-b5f4-7e2a-9e5a-5d0e4c07b1a3","text":"hello","urn":"webchat:65vbbDAQCdPdEWlEhDGy4utO","attachments":["https://example.com/attachments/1234.jpg"],"received_on":"2024-05-02T16:05:04.123456Z"}]}`)),
+			httpx.NewMockResponse(200, nil, nil),
 			httpx.NewMockResponse(200, nil, nil),
 			httpx.NewMockResponse(200, nil, nil),
 			httpx.NewMockResponse(200, nil, nil),
 			httpx.NewMockResponse(400, nil, nil),
+			httpx.NewMockResponse(200, nil, []byte(`{"message":"Events Handled","data":[]}`)),
+			httpx.NewMockResponse(200, nil, nil),
+			httpx.NewMockResponse(200, nil, []byte(`OK`)),
 		},
 	})
 	httpx.SetRequestor(mocks)
@@ -49,23 +60,55 @@ func TestCourier(t *testing.T) {
 	bob, err := models.LoadContact(ctx, rt, orgID, "65vbbDAQCdPdEWlEhDGy4utO")
 	require.NoError(t, err)
 
-	err = c.StartChat(ctx, channel, "65vbbDAQCdPdEWlEhDGy4utO")
+	err = c.StartChat(ctx, channel, "65vbbDAQCdPdEWlEhDGy4utO", nil)
 	assert.NoError(t, err)
 	assert.Equal(t, "POST", mocks.Requests()[0].Method)
 	assert.Equal(t, `{"chat_id":"65vbbDAQCdPdEWlEhDGy4utO","secret":"sesame","events":[{"type":"chat_started"}]}`, getBody(mocks.Requests()[0]))
 
-	err = c.CreateMsg(ctx, channel, bob, "hello")
+	msgIn, err := c.CreateMsg(ctx, channel, bob, "hello", []string{"https://example.com/attachments/1234.jpg"}, models.NilMsgID, courier.MsgFlags{})
 	assert.NoError(t, err)
+	assert.Equal(t, &models.MsgIn{UUID: "0191a4e4-b5f4-7e2a-9e5a-5d0e4c07b1a3", Text: "hello", Attachments: []string{"https://example.com/attachments/1234.jpg"}, Time: time.Date(2024, 5, 2, 16, 5, 4, 123456000, time.UTC)}, msgIn)
 	assert.Equal(t, "POST", mocks.Requests()[1].Method)
-	assert.Equal(t, `{"chat_id":"65vbbDAQCdPdEWlEhDGy4utO","secret":"sesame","events":[{"type":"msg_in","msg":{"text":"hello"}}]}`, getBody(mocks.Requests()[1]))
+	assert.Equal(t, `{"chat_id":"65vbbDAQCdPdEWlEhDGy4utO","secret":"sesame","events":[{"type":"msg_in","msg":{"text":"hello","attachments":["https://example.com/attachments/1234.jpg"]}}]}`, getBody(mocks.Requests()[1]))
 
-	err = c.ReportDelivered(ctx, channel, bob, 1)
+	err = c.ReportStatus(ctx, channel, bob, []models.MsgID{1}, courier.MsgStatusDelivered)
 	assert.NoError(t, err)
 	assert.Equal(t, "POST", mocks.Requests()[2].Method)
 	assert.Equal(t, `{"chat_id":"65vbbDAQCdPdEWlEhDGy4utO","secret":"sesame","events":[{"type":"msg_status","status":{"msg_id":1,"status":"delivered"}}]}`, getBody(mocks.Requests()[2]))
 
-	err = c.StartChat(ctx, channel, "65vbbDAQCdPdEWlEhDGy4utO")
+	// statuses of several messages are reported together
+	err = c.ReportStatus(ctx, channel, bob, []models.MsgID{2, 3}, courier.MsgStatusFailed)
+	assert.NoError(t, err)
+	assert.Equal(t, "POST", mocks.Requests()[3].Method)
+	assert.Equal(t, `{"chat_id":"65vbbDAQCdPdEWlEhDGy4utO","secret":"sesame","events":[{"type":"msg_status","status":{"msg_id":2,"status":"failed"}},{"type":"msg_status","status":{"msg_id":3,"status":"failed"}}]}`, getBody(mocks.Requests()[3]))
+
+	err = c.ReportTyping(ctx, channel, bob)
+	assert.NoError(t, err)
+	assert.Equal(t, "POST", mocks.Requests()[4].Method)
+	assert.Equal(t, `{"chat_id":"65vbbDAQCdPdEWlEhDGy4utO","secret":"sesame","events":[{"type":"typing"}]}`, getBody(mocks.Requests()[4]))
+
+	err = c.StartChat(ctx, channel, "3xdF7KhyEiabBiCd3Cst3X28", &models.Identity{ExternalID: "12345", Name: "Ann", Email: "ann@nyaruka.com", Fields: map[string]string{"plan": "gold"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "POST", mocks.Requests()[5].Method)
+	assert.Equal(t, `{"chat_id":"3xdF7KhyEiabBiCd3Cst3X28","secret":"sesame","events":[{"type":"chat_started","identity":{"external_id":"12345","name":"Ann","email":"ann@nyaruka.com","fields":{"plan":"gold"}}}]}`, getBody(mocks.Requests()[5]))
+
+	err = c.StartChat(ctx, channel, "65vbbDAQCdPdEWlEhDGy4utO", nil)
 	assert.EqualError(t, err, "courier returned non-2XX status")
 
+	// if courier accepted the message but its response doesn't describe it, message was still created
+	msgIn, err = c.CreateMsg(ctx, channel, bob, "Yes", nil, 345, courier.MsgFlags{OutOfHours: true})
+	assert.NoError(t, err)
+	assert.Equal(t, &models.MsgIn{Text: "Yes", ReplyTo: 345, Time: time.Date(2024, 5, 2, 16, 5, 4, 0, time.UTC)}, msgIn)
+	assert.Equal(t, `{"chat_id":"65vbbDAQCdPdEWlEhDGy4utO","secret":"sesame","events":[{"type":"msg_in","msg":{"text":"Yes","reply_to_id":345,"out_of_hours":true}}]}`, getBody(mocks.Requests()[7]))
+
+	err = c.UpdateContact(ctx, channel, bob, &models.ContactUpdate{Name: "Bob", Fields: map[string]string{"age": "32"}})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"chat_id":"65vbbDAQCdPdEWlEhDGy4utO","secret":"sesame","events":[{"type":"contact_update","contact":{"name":"Bob","fields":{"age":"32"}}}]}`, getBody(mocks.Requests()[8]))
+
+	// same if its response can't be parsed at all
+	msgIn, err = c.CreateMsg(ctx, channel, bob, "No", nil, models.NilMsgID, courier.MsgFlags{})
+	assert.NoError(t, err)
+	assert.Equal(t, &models.MsgIn{Text: "No", Time: time.Date(2024, 5, 2, 16, 5, 4, 0, time.UTC)}, msgIn)
+
 	assert.False(t, mocks.HasUnused())
 }
@@ -16,16 +16,49 @@ func (e *baseEvent) Type() string {
 
 type chatStartedEvent struct {
 	baseEvent
+	Identity *models.Identity `json:"identity,omitempty"`
 }
 
-func newChatStartedEvent() Event {
+func newChatStartedEvent(identity *models.Identity) Event {
 	return &chatStartedEvent{
 		baseEvent: baseEvent{Type_: "chat_started"},
+		Identity:  identity,
 	}
 }
 
+type typingEvent struct {
+	baseEvent
+}
+
+func newTypingEvent() Event {
+	return &typingEvent{
+		baseEvent: baseEvent{Type_: "typing"},
+	}
+}
+
+type contactUpdateEvent struct {
+	baseEvent
+	Contact *models.ContactUpdate `json:"contact"`
+}
+
+func newContactUpdateEvent(update *models.ContactUpdate) Event {
+	return &contactUpdateEvent{
+		baseEvent: baseEvent{Type_: "contact_update"},
+		Contact:   update,
+	}
+}
+
+// MsgFlags tell courier how an incoming message should be handled
+type MsgFlags struct {
+	OutOfHours bool `json:"out_of_hours,omitempty"` // sent when the channel's schedule says nobody is available
+	OpenTicket bool `json:"open_ticket,omitempty"`  // left with the offline form so should open a ticket
+}
+
 type msgIn struct {
-	Text string `json:"text"`
+	Text        string       `json:"text"`
+	Attachments []string     `json:"attachments,omitempty"`
+	ReplyToID   models.MsgID `json:"reply_to_id,omitempty"`
+	MsgFlags
 }
 
 type msgInEvent struct {
@@ -33,10 +66,10 @@ type msgInEvent struct {
 	Msg msgIn `json:"msg"`
 }
 
-func newMsgInEvent(text string) Event {
+func newMsgInEvent(text string, attachments []string, replyToID models.MsgID, flags MsgFlags) Event {
 	return &msgInEvent{
 		baseEvent: baseEvent{Type_: "msg_in"},
-		Msg:       msgIn{Text: text},
+		Msg:       msgIn{Text: text, Attachments: attachments, ReplyToID: replyToID, MsgFlags: flags},
 	}
 }
 
@@ -44,6 +77,9 @@ type MsgStatus string
 
 const (
 	MsgStatusDelivered MsgStatus = "delivered"
+	MsgStatusRead      MsgStatus = "read"
+	MsgStatusErrored   MsgStatus = "errored"
+	MsgStatusFailed    MsgStatus = "failed"
 )
 
 type msgStatusUpdate struct {
@@ -0,0 +1,51 @@
+package dedupe
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/chip/core/models"
+)
+
+// Commands tracks the IDs of commands recently handled for each chat, along with their responses, so that commands
+// retried by clients aren't handled twice
+type Commands struct {
+	KeyBase string
+	TTL     time.Duration
+}
+
+// Claim marks the given command as being handled and returns true, or if it was already claimed, returns false and
+// whatever response was recorded for it, which will be empty if it's still being handled
+func (c *Commands) Claim(rc redis.Conn, ch *models.Channel, chatID models.ChatID, id string) (bool, []byte, error) {
+	key := c.commandKey(ch, chatID, id)
+
+	_, err := redis.String(rc.Do("SET", key, "", "NX", "EX", int(c.TTL/time.Second)))
+	if err == nil {
+		return true, nil, nil
+	} else if err != redis.ErrNil {
+		return false, nil, err
+	}
+
+	response, err := redis.Bytes(rc.Do("GET", key))
+	if err != nil && err != redis.ErrNil {
+		return false, nil, err
+	}
+	return false, response, nil
+}
+
+// Complete records the response to a claimed command so that it can be sent again if the command is retried
+func (c *Commands) Complete(rc redis.Conn, ch *models.Channel, chatID models.ChatID, id string, response []byte) error {
+	_, err := rc.Do("SET", c.commandKey(ch, chatID, id), response, "XX", "EX", int(c.TTL/time.Second))
+	return err
+}
+
+// Release removes a claimed command, e.g. because handling it failed and the client should be able to retry it
+func (c *Commands) Release(rc redis.Conn, ch *models.Channel, chatID models.ChatID, id string) error {
+	_, err := rc.Do("DEL", c.commandKey(ch, chatID, id))
+	return err
+}
+
+func (c *Commands) commandKey(ch *models.Channel, chatID models.ChatID, id string) string {
+	return fmt.Sprintf("%s:command:%s@%s:%s", c.KeyBase, chatID, ch.UUID, id)
+}
@@ -0,0 +1,58 @@
+package dedupe_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/chip/core/dedupe"
+	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/chip/testsuite"
+	"github.com/nyaruka/vkutil/assertvk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommands(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetValkey()
+
+	ch := &models.Channel{UUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9"}
+	c := &dedupe.Commands{KeyBase: "chattest", TTL: time.Hour}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	claim := func(chatID models.ChatID, id string) (bool, string) {
+		claimed, response, err := c.Claim(rc, ch, chatID, id)
+		require.NoError(t, err)
+		return claimed, string(response)
+	}
+
+	// first time a command is seen, it can be claimed
+	claimed, _ := claim("65vbbDAQCdPdEWlEhDGy4utO", "cmd1")
+	assert.True(t, claimed)
+	assertvk.Exists(t, rc, "chattest:command:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9:cmd1")
+
+	// but not again whilst it's being handled
+	claimed, response := claim("65vbbDAQCdPdEWlEhDGy4utO", "cmd1")
+	assert.False(t, claimed)
+	assert.Equal(t, "", response)
+
+	// same ID is a different command in another chat
+	claimed, _ = claim("3xdF7KhyEiabBiCd3Cst3X28", "cmd1")
+	assert.True(t, claimed)
+
+	// once it's been handled, retries get its response
+	require.NoError(t, c.Complete(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", "cmd1", []byte(`{"type":"msg_in_created"}`)))
+
+	claimed, response = claim("65vbbDAQCdPdEWlEhDGy4utO", "cmd1")
+	assert.False(t, claimed)
+	assert.Equal(t, `{"type":"msg_in_created"}`, response)
+
+	// a released command can be claimed again
+	require.NoError(t, c.Release(rc, ch, "3xdF7KhyEiabBiCd3Cst3X28", "cmd1"))
+
+	claimed, _ = claim("3xdF7KhyEiabBiCd3Cst3X28", "cmd1")
+	assert.True(t, claimed)
+}
@@ -0,0 +1,139 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Mailer is the interface for sending emails via an SMTP server or a local stand-in
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// NewMailer creates a new mailer from the given SMTP server URL, or a logging stand-in if that is empty
+func NewMailer(smtpServer string) (Mailer, error) {
+	if smtpServer == "" {
+		return &logMailer{}, nil
+	}
+	return NewSMTPMailer(smtpServer)
+}
+
+type smtpMailer struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+}
+
+// NewSMTPMailer creates a new mailer from a URL like smtp://user%40password@server:port/?from=foo%40gmail.com
+func NewSMTPMailer(smtpServer string) (Mailer, error) {
+	u, err := url.Parse(smtpServer)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing SMTP server URL: %w", err)
+	}
+	if u.Scheme != "smtp" || u.Hostname() == "" {
+		return nil, fmt.Errorf("SMTP server URL must be of the form smtp://host:port")
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "25"
+	}
+
+	password, _ := u.User.Password()
+	from := u.Query().Get("from")
+	if from == "" {
+		from = fmt.Sprintf("no-reply@%s", u.Hostname())
+	}
+
+	return &smtpMailer{host: u.Hostname(), port: port, username: u.User.Username(), password: password, from: from}, nil
+}
+
+func (m *smtpMailer) Send(ctx context.Context, to, subject, body string) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + m.from,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	if err := m.send(ctx, auth, to, []byte(msg)); err != nil {
+		return fmt.Errorf("error sending email: %w", err)
+	}
+	return nil
+}
+
+// sends a message like smtp.SendMail, but gives up when the given context is done so that a hung server can't block us
+func (m *smtpMailer) send(ctx context.Context, auth smtp.Auth, to string, msg []byte) error {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(m.host, m.port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// stand-in mailer for local development which just logs emails
+type logMailer struct{}
+
+func (m *logMailer) Send(ctx context.Context, to, subject, body string) error {
+	slog.With("comp", "mailer").Info("email sent", "to", to, "subject", subject, "body", body)
+	return nil
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/nyaruka/chip/runtime"
 	"github.com/nyaruka/gocommon/dbutil"
+	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/uuids"
 )
 
@@ -18,6 +22,8 @@ type Channel struct {
 	UUID   ChannelUUID    `json:"uuid"`
 	OrgID  OrgID          `json:"org_id"`
 	Config map[string]any `json:"config"`
+
+	schedule *Schedule // parsed from config when the channel is loaded
 }
 
 func (c *Channel) Secret() string {
@@ -25,6 +31,143 @@ func (c *Channel) Secret() string {
 	return s
 }
 
+// IdentityKey returns the key used by the host site to sign visitor identities, if it has one
+func (c *Channel) IdentityKey() string {
+	s, _ := c.Config["identity_key"].(string)
+	return s
+}
+
+// AttachmentMaxSize returns the maximum size in bytes of attachments which can be uploaded on this channel
+func (c *Channel) AttachmentMaxSize(cfg *runtime.Config) int {
+	if v, ok := c.Config["attachment_max_size"].(float64); ok && v > 0 {
+		return int(v)
+	}
+	return cfg.AttachmentMaxSize
+}
+
+// AttachmentTypes returns the content types of attachments which can be uploaded on this channel, which may include
+// wildcards like image/*
+func (c *Channel) AttachmentTypes(cfg *runtime.Config) []string {
+	if v, ok := c.Config["attachment_types"].([]any); ok {
+		return toStrings(v)
+	}
+	return strings.Split(cfg.AttachmentTypes, ",")
+}
+
+// AllowedOrigins returns the origins of sites which can embed the webchat widget for this channel, which may include
+// wildcards like https://*.example.com or just *
+func (c *Channel) AllowedOrigins(cfg *runtime.Config) []string {
+	if v, ok := c.Config["allowed_origins"].([]any); ok {
+		return toStrings(v)
+	}
+	return strings.Split(cfg.AllowedOrigins, ",")
+}
+
+// UpdatableFields returns the contact fields which the widget can set on this channel, which may include name and
+// language as well as the keys of contact fields
+func (c *Channel) UpdatableFields(cfg *runtime.Config) []string {
+	if v, ok := c.Config["updatable_fields"].([]any); ok {
+		return toStrings(v)
+	}
+	return strings.Split(cfg.UpdatableFields, ",")
+}
+
+// RateLimit returns the limit on the given action (e.g. connect or send_msg) for the given scope (socket, ip or channel)
+// on this channel, e.g. 30/1m. Limits for specific actions fall back to the limit for the scope.
+func (c *Channel) RateLimit(cfg *runtime.Config, scope, action string) string {
+	if v, ok := c.Config["rate_limit_"+scope+"."+action].(string); ok && v != "" {
+		return v
+	}
+	if v, ok := c.Config["rate_limit_"+scope].(string); ok && v != "" {
+		return v
+	}
+
+	switch scope {
+	case "socket":
+		return cfg.RateLimitSocket
+	case "ip":
+		return cfg.RateLimitIP
+	case "channel":
+		return cfg.RateLimitChannel
+	}
+	return ""
+}
+
+// Schedule returns the business hours of this channel, or nil if it doesn't have any or they're invalid
+func (c *Channel) Schedule() *Schedule {
+	return c.schedule
+}
+
+// Availability returns whether someone is available to chat on this channel at the given time. Channels without a
+// schedule, or with an invalid one, are always online.
+func (c *Channel) Availability(now time.Time) *Availability {
+	if c.schedule == nil {
+		return &Availability{Online: true}
+	}
+	return c.schedule.Availability(now)
+}
+
+// parses the schedule in the config of this channel, if it has one
+func (c *Channel) readSchedule() error {
+	v, ok := c.Config["schedule"]
+	if !ok || v == nil {
+		return nil
+	}
+
+	schedule, err := ReadSchedule(jsonx.MustMarshal(v))
+	if err != nil {
+		return err
+	}
+	c.schedule = schedule
+	return nil
+}
+
+// WidgetConfig is the presentation and behaviour settings of a channel which the widget needs, and which are public
+type WidgetConfig struct {
+	Title             string            `json:"title,omitempty"`
+	Colors            map[string]string `json:"colors,omitempty"`
+	WelcomeMessage    string            `json:"welcome_message,omitempty"`
+	PrechatFields     []string          `json:"prechat_fields,omitempty"`
+	Languages         []string          `json:"languages,omitempty"`
+	AttachmentTypes   []string          `json:"attachment_types"`
+	AttachmentMaxSize int               `json:"attachment_max_size"`
+}
+
+// WidgetConfig returns the settings of this channel which the widget needs, leaving out anything secret
+func (c *Channel) WidgetConfig(cfg *runtime.Config) *WidgetConfig {
+	wc := &WidgetConfig{AttachmentTypes: c.AttachmentTypes(cfg), AttachmentMaxSize: c.AttachmentMaxSize(cfg)}
+
+	wc.Title, _ = c.Config["title"].(string)
+	wc.WelcomeMessage, _ = c.Config["welcome_message"].(string)
+
+	if v, ok := c.Config["colors"].(map[string]any); ok {
+		wc.Colors = make(map[string]string, len(v))
+		for key, color := range v {
+			if s, ok := color.(string); ok {
+				wc.Colors[key] = s
+			}
+		}
+	}
+	if v, ok := c.Config["prechat_fields"].([]any); ok {
+		wc.PrechatFields = toStrings(v)
+	}
+	if v, ok := c.Config["languages"].([]any); ok {
+		wc.Languages = toStrings(v)
+	}
+
+	return wc
+}
+
+func toStrings(vs []any) []string {
+	ss := make([]string, 0, len(vs))
+	for _, v := range vs {
+		if s, ok := v.(string); ok {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
 const sqlSelectChannel = `
 SELECT row_to_json(r) FROM (
 	SELECT id, uuid, org_id, config 
@@ -46,5 +189,11 @@ func LoadChannel(ctx context.Context, rt *runtime.Runtime, uuid ChannelUUID) (*C
 	if err := dbutil.ScanJSON(rows, ch); err != nil {
 		return nil, fmt.Errorf("error scanning channel: %w", err)
 	}
+
+	// an invalid schedule shouldn't stop the channel working, it's just always online
+	if err := ch.readSchedule(); err != nil {
+		slog.Warn("channel has invalid schedule", "channel", uuid, "error", err)
+	}
+
 	return ch, nil
 }
@@ -2,8 +2,10 @@ package models_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/chip/runtime"
 	"github.com/nyaruka/chip/testsuite"
 	"github.com/stretchr/testify/assert"
 )
@@ -24,4 +26,76 @@ func TestLoadChannel(t *testing.T) {
 	assert.Equal(t, models.ChannelUUID("8291264a-4581-4d12-96e5-e9fcfa6e68d9"), ch.UUID)
 	assert.Equal(t, orgID, ch.OrgID)
 	assert.Equal(t, "sesame", ch.Secret())
+	assert.Equal(t, 10*1024*1024, ch.AttachmentMaxSize(rt.Config))
+	assert.Equal(t, []string{"image/*", "audio/*", "video/*", "application/pdf"}, ch.AttachmentTypes(rt.Config))
+	assert.Equal(t, []string{"*"}, ch.AllowedOrigins(rt.Config))
+	assert.Equal(t, []string{"name", "language"}, ch.UpdatableFields(rt.Config))
+	assert.Equal(t, "30/1m", ch.RateLimit(rt.Config, "socket", "send_msg"))
+	assert.Equal(t, "60/1m", ch.RateLimit(rt.Config, "ip", "connect"))
+	assert.Equal(t, "1000/1m", ch.RateLimit(rt.Config, "channel", "start_chat"))
+
+	// channel can override attachment limits, allowed origins, updatable fields and rate limits
+	ch.Config["attachment_max_size"] = float64(1024)
+	ch.Config["attachment_types"] = []any{"image/png", "image/jpeg"}
+	ch.Config["allowed_origins"] = []any{"https://example.com", "https://*.example.org"}
+	ch.Config["updatable_fields"] = []any{"name", "age"}
+	ch.Config["rate_limit_ip"] = "5/1s"
+	ch.Config["rate_limit_ip.start_chat"] = "2/1m"
+
+	assert.Equal(t, 1024, ch.AttachmentMaxSize(rt.Config))
+	assert.Equal(t, []string{"image/png", "image/jpeg"}, ch.AttachmentTypes(rt.Config))
+	assert.Equal(t, []string{"https://example.com", "https://*.example.org"}, ch.AllowedOrigins(rt.Config))
+	assert.Equal(t, []string{"name", "age"}, ch.UpdatableFields(rt.Config))
+	assert.Equal(t, "30/1m", ch.RateLimit(rt.Config, "socket", "send_msg"))
+	assert.Equal(t, "5/1s", ch.RateLimit(rt.Config, "ip", "send_msg"))
+	assert.Equal(t, "2/1m", ch.RateLimit(rt.Config, "ip", "start_chat"))
+
+	// channel without a schedule is always online
+	assert.Nil(t, ch.Schedule())
+	assert.True(t, ch.Availability(time.Now()).Online)
+
+	// schedule is read when the channel is loaded
+	testsuite.InsertChannel(rt, "3a9b0b9e-4b0d-4fa6-9e2c-d0d9eb2c7c3a", orgID, "CHP", "Web Chat", "", []string{"webchat"}, map[string]any{"secret": "sesame", "schedule": map[string]any{"timezone": "Africa/Kigali", "hours": map[string]any{"mon": []any{"08:00-17:00"}}}})
+
+	ch, err = models.LoadChannel(ctx, rt, "3a9b0b9e-4b0d-4fa6-9e2c-d0d9eb2c7c3a")
+	assert.NoError(t, err)
+	assert.NotNil(t, ch.Schedule())
+	assert.True(t, ch.Availability(time.Date(2024, 5, 6, 9, 0, 0, 0, time.UTC)).Online) // Monday
+	assert.False(t, ch.Availability(time.Date(2024, 5, 7, 9, 0, 0, 0, time.UTC)).Online)
+
+	// and an invalid one doesn't stop the channel loading but it's always online
+	testsuite.InsertChannel(rt, "5b2c0b9e-4b0d-4fa6-9e2c-d0d9eb2c7c3a", orgID, "CHP", "Web Chat", "", []string{"webchat"}, map[string]any{"secret": "sesame", "schedule": map[string]any{"timezone": "Africa/Nowhere"}})
+
+	ch, err = models.LoadChannel(ctx, rt, "5b2c0b9e-4b0d-4fa6-9e2c-d0d9eb2c7c3a")
+	assert.NoError(t, err)
+	assert.Nil(t, ch.Schedule())
+	assert.True(t, ch.Availability(time.Date(2024, 5, 7, 9, 0, 0, 0, time.UTC)).Online)
+}
+
+func TestWidgetConfig(t *testing.T) {
+	cfg := runtime.NewDefaultConfig()
+
+	ch := &models.Channel{UUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9", Config: map[string]any{"secret": "sesame"}}
+
+	assert.Equal(t, &models.WidgetConfig{
+		AttachmentTypes:   []string{"image/*", "audio/*", "video/*", "application/pdf"},
+		AttachmentMaxSize: 10 * 1024 * 1024,
+	}, ch.WidgetConfig(cfg))
+
+	ch.Config["title"] = "Nyaruka Support"
+	ch.Config["colors"] = map[string]any{"primary": "#2387CA", "background": "#FFFFFF"}
+	ch.Config["welcome_message"] = "Hi there! How can we help?"
+	ch.Config["prechat_fields"] = []any{"name", "email"}
+	ch.Config["languages"] = []any{"eng", "spa"}
+	ch.Config["attachment_types"] = []any{"image/png"}
+
+	assert.Equal(t, &models.WidgetConfig{
+		Title:             "Nyaruka Support",
+		Colors:            map[string]string{"primary": "#2387CA", "background": "#FFFFFF"},
+		WelcomeMessage:    "Hi there! How can we help?",
+		PrechatFields:     []string{"name", "email"},
+		Languages:         []string{"eng", "spa"},
+		AttachmentTypes:   []string{"image/png"},
+		AttachmentMaxSize: 10 * 1024 * 1024,
+	}, ch.WidgetConfig(cfg))
 }
@@ -3,7 +3,9 @@ package models
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
 
 	"github.com/nyaruka/chip/runtime"
 	"github.com/nyaruka/gocommon/dbutil"
@@ -51,6 +53,32 @@ func (c *Contact) UpdateEmail(ctx context.Context, rt *runtime.Runtime, email st
 	return nil
 }
 
+// ContactUpdate is a change to a contact's name, language or fields requested by the contact
+type ContactUpdate struct {
+	Name     string            `json:"name,omitempty"`
+	Language string            `json:"language,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+}
+
+// ErrFieldNotAllowed is returned when a contact tries to set a field which the channel doesn't allow
+var ErrFieldNotAllowed = errors.New("field not allowed")
+
+// Check checks that this update only sets fields in the given allow-list
+func (u *ContactUpdate) Check(allowed []string) error {
+	if u.Name != "" && !slices.Contains(allowed, "name") {
+		return fmt.Errorf("%w: name", ErrFieldNotAllowed)
+	}
+	if u.Language != "" && !slices.Contains(allowed, "language") {
+		return fmt.Errorf("%w: language", ErrFieldNotAllowed)
+	}
+	for key := range u.Fields {
+		if !slices.Contains(allowed, key) {
+			return fmt.Errorf("%w: %s", ErrFieldNotAllowed, key)
+		}
+	}
+	return nil
+}
+
 const sqlSelectContact = `
 SELECT row_to_json(r) FROM (
 	SELECT contact_id AS id, org_id, id AS urn_id, path AS chat_id, display AS email 
@@ -53,3 +53,17 @@ func TestContact(t *testing.T) {
 	assert.Equal(t, models.ChatID("65vbbDAQCdPdEWlEhDGy4utO"), bob.ChatID)
 	assert.Equal(t, "bob@nyaruka.com", bob.Email)
 }
+
+func TestContactUpdate(t *testing.T) {
+	allowed := []string{"name", "age"}
+
+	assert.NoError(t, (&models.ContactUpdate{Name: "Bob"}).Check(allowed))
+	assert.NoError(t, (&models.ContactUpdate{Fields: map[string]string{"age": "32"}}).Check(allowed))
+
+	err := (&models.ContactUpdate{Language: "spa"}).Check(allowed)
+	assert.ErrorIs(t, err, models.ErrFieldNotAllowed)
+	assert.EqualError(t, err, "field not allowed: language")
+
+	err = (&models.ContactUpdate{Name: "Bob", Fields: map[string]string{"age": "32", "plan": "gold"}}).Check(allowed)
+	assert.EqualError(t, err, "field not allowed: plan")
+}
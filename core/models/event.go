@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"github.com/nyaruka/gocommon/uuids"
+)
+
+type ChatEventType string
+
+const (
+	ChatEventTypeTicketOpened   ChatEventType = "ticket_opened"
+	ChatEventTypeTicketClosed   ChatEventType = "ticket_closed"
+	ChatEventTypeTicketAssigned ChatEventType = "ticket_assigned"
+)
+
+// ChatEvent is something other than a message that happened in a chat which the contact should know about, e.g. their
+// ticket being closed
+type ChatEvent struct {
+	UUID     uuids.UUID    `json:"uuid"`
+	Type     ChatEventType `json:"type"`
+	Assignee *User         `json:"assignee,omitempty"`
+	Time     time.Time     `json:"time"`
+}
+
+func NewChatEvent(uuid uuids.UUID, type_ ChatEventType, assignee *User, t time.Time) *ChatEvent {
+	return &ChatEvent{UUID: uuid, Type: type_, Assignee: assignee, Time: t}
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/nyaruka/gocommon/dates"
+)
+
+// Identity is a visitor identity provided by a host site which already knows who the visitor is
+type Identity struct {
+	ExternalID string            `json:"external_id"`
+	Name       string            `json:"name,omitempty"`
+	Email      string            `json:"email,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+type identityClaims struct {
+	jwt.RegisteredClaims
+
+	Name   string            `json:"name"`
+	Email  string            `json:"email"`
+	Fields map[string]string `json:"fields"`
+}
+
+// ParseIdentity parses and verifies an identity JWT which should be signed (HS256) with the channel's identity key, and
+// have the external ID of the visitor as its subject
+func ParseIdentity(ch *Channel, token string) (*Identity, error) {
+	key := ch.IdentityKey()
+	if key == "" {
+		return nil, errors.New("channel has no identity key")
+	}
+
+	claims := &identityClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) { return []byte(key), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(dates.Now),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying identity token: %w", err)
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("identity token has no subject")
+	}
+
+	return &Identity{ExternalID: claims.Subject, Name: claims.Name, Email: claims.Email, Fields: claims.Fields}, nil
+}
+
+// ChatID returns the chat ID for this identity on the given channel, which is always the same so that a visitor can
+// resume their chat from any device. It's keyed with the channel's secret so that it can't be derived from an external
+// ID alone, but not with the identity key, so that key can be changed without moving visitors to new chats.
+func (i *Identity) ChatID(ch *Channel) ChatID {
+	mac := hmac.New(sha256.New, []byte(ch.Secret()))
+	mac.Write([]byte(fmt.Sprintf("%s:%s", ch.UUID, i.ExternalID)))
+	sum := mac.Sum(nil)
+
+	id := make([]rune, 24)
+	for j := range id {
+		id[j] = chatIDRunes[int(sum[j])%len(chatIDRunes)]
+	}
+	return ChatID(id)
+}
+
+// Update returns the contact update for the name and fields of this identity, or nil if it has neither
+func (i *Identity) Update() *ContactUpdate {
+	if i.Name == "" && len(i.Fields) == 0 {
+		return nil
+	}
+	return &ContactUpdate{Name: i.Name, Fields: i.Fields}
+}
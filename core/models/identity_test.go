@@ -0,0 +1,73 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentity(t *testing.T) {
+	defer dates.SetNowFunc(time.Now)
+	dates.SetNowFunc(dates.NewFixedNow(time.Date(2024, 5, 2, 16, 5, 4, 0, time.UTC)))
+
+	ch1 := &models.Channel{UUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9", Config: map[string]any{"secret": "sesame", "identity_key": "s3cret"}}
+	ch2 := &models.Channel{UUID: "3a9b0b9e-4b0d-4fa6-9e2c-d0d9eb2c7c3a", Config: map[string]any{"secret": "sesame", "identity_key": "s3cret"}}
+	ch3 := &models.Channel{UUID: "5b2c0b9e-4b0d-4fa6-9e2c-d0d9eb2c7c3a", Config: map[string]any{"secret": "sesame"}}
+
+	sign := func(method jwt.SigningMethod, key any, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		require.NoError(t, err)
+		return token
+	}
+	expires := time.Date(2024, 5, 2, 17, 0, 0, 0, time.UTC).Unix()
+
+	token := sign(jwt.SigningMethodHS256, []byte("s3cret"), jwt.MapClaims{"sub": "12345", "name": "Ann", "email": "ann@nyaruka.com", "fields": map[string]string{"plan": "gold"}, "exp": expires})
+
+	identity, err := models.ParseIdentity(ch1, token)
+	assert.NoError(t, err)
+	assert.Equal(t, &models.Identity{ExternalID: "12345", Name: "Ann", Email: "ann@nyaruka.com", Fields: map[string]string{"plan": "gold"}}, identity)
+
+	// chat IDs are always the same for the same channel and external ID
+	assert.Equal(t, identity.ChatID(ch1), (&models.Identity{ExternalID: "12345"}).ChatID(ch1))
+	assert.Regexp(t, `^[a-zA-Z0-9]{24}$`, identity.ChatID(ch1))
+	assert.NotEqual(t, identity.ChatID(ch1), identity.ChatID(ch2))
+	assert.NotEqual(t, identity.ChatID(ch1), (&models.Identity{ExternalID: "12346"}).ChatID(ch1))
+
+	// and depend on the channel's secret, but not its identity key, so that key can be rotated
+	ch4 := &models.Channel{UUID: ch1.UUID, Config: map[string]any{"secret": "sesame", "identity_key": "0ther"}}
+	ch5 := &models.Channel{UUID: ch1.UUID, Config: map[string]any{"secret": "0pen", "identity_key": "s3cret"}}
+	assert.Equal(t, identity.ChatID(ch1), identity.ChatID(ch4))
+	assert.NotEqual(t, identity.ChatID(ch1), identity.ChatID(ch5))
+
+	assert.Equal(t, &models.ContactUpdate{Name: "Ann", Fields: map[string]string{"plan": "gold"}}, identity.Update())
+	assert.Nil(t, (&models.Identity{ExternalID: "12345", Email: "ann@nyaruka.com"}).Update())
+
+	// channel without an identity key
+	_, err = models.ParseIdentity(ch3, token)
+	assert.EqualError(t, err, "channel has no identity key")
+
+	// token signed with wrong key
+	_, err = models.ParseIdentity(ch1, sign(jwt.SigningMethodHS256, []byte("xyz"), jwt.MapClaims{"sub": "12345", "exp": expires}))
+	assert.ErrorIs(t, err, jwt.ErrTokenSignatureInvalid)
+
+	// token signed with a different method
+	_, err = models.ParseIdentity(ch1, sign(jwt.SigningMethodHS512, []byte("s3cret"), jwt.MapClaims{"sub": "12345", "exp": expires}))
+	assert.ErrorIs(t, err, jwt.ErrTokenSignatureInvalid)
+
+	// token without an expiry
+	_, err = models.ParseIdentity(ch1, sign(jwt.SigningMethodHS256, []byte("s3cret"), jwt.MapClaims{"sub": "12345"}))
+	assert.ErrorIs(t, err, jwt.ErrTokenRequiredClaimMissing)
+
+	// token which has expired
+	_, err = models.ParseIdentity(ch1, sign(jwt.SigningMethodHS256, []byte("s3cret"), jwt.MapClaims{"sub": "12345", "exp": time.Date(2024, 5, 2, 16, 0, 0, 0, time.UTC).Unix()}))
+	assert.ErrorIs(t, err, jwt.ErrTokenExpired)
+
+	// token without a subject
+	_, err = models.ParseIdentity(ch1, sign(jwt.SigningMethodHS256, []byte("s3cret"), jwt.MapClaims{"exp": expires}))
+	assert.EqualError(t, err, "identity token has no subject")
+}
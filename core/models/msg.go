@@ -2,16 +2,23 @@ package models
 
 import (
 	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/nyaruka/chip/runtime"
 	"github.com/nyaruka/gocommon/dbutil"
+	"github.com/nyaruka/gocommon/uuids"
 )
 
 type MsgID int64
+type MsgUUID uuids.UUID
 type MsgOrigin string
 type MsgDirection string
+type MsgStatus string
 
 const (
 	NilMsgID MsgID = 0
@@ -23,25 +30,62 @@ const (
 
 	DirectionIn  MsgDirection = "I"
 	DirectionOut MsgDirection = "O"
+
+	MsgStatusQueued    MsgStatus = "queued"
+	MsgStatusSent      MsgStatus = "sent"
+	MsgStatusDelivered MsgStatus = "delivered"
+	MsgStatusRead      MsgStatus = "read"
+	MsgStatusErrored   MsgStatus = "errored"
+	MsgStatusFailed    MsgStatus = "failed"
+	MsgStatusHandled   MsgStatus = "handled"
 )
 
-type MsgIn struct {
-	ID   MsgID     `json:"id"`
-	Text string    `json:"text"`
-	Time time.Time `json:"time"`
-}
+// ErrAttachmentNotUploaded is returned when a contact tries to send an attachment which they didn't upload
+var ErrAttachmentNotUploaded = errors.New("attachment not uploaded by contact")
 
-func NewMsgIn(id MsgID, text string, t time.Time) *MsgIn {
-	return &MsgIn{ID: id, Text: text, Time: t}
+// ErrInvalidReplyTo is returned when a contact tries to reply to a message which wasn't sent to them
+var ErrInvalidReplyTo = errors.New("reply_to is not a message sent to contact")
+
+// maps the status codes used in the database to the statuses we expose to clients
+var dbStatuses = map[string]MsgStatus{
+	"I": MsgStatusQueued,
+	"P": MsgStatusQueued,
+	"Q": MsgStatusQueued,
+	"W": MsgStatusSent,
+	"S": MsgStatusSent,
+	"D": MsgStatusDelivered,
+	"R": MsgStatusRead,
+	"E": MsgStatusErrored,
+	"F": MsgStatusFailed,
+	"H": MsgStatusHandled,
 }
 
-type MsgOut struct {
-	ID          MsgID     `json:"id"`
+type MsgIn struct {
+	ID          MsgID     `json:"id,omitempty"`
+	UUID        MsgUUID   `json:"-"`
 	Text        string    `json:"text"`
 	Attachments []string  `json:"attachments,omitempty"`
-	Origin      MsgOrigin `json:"origin"`
-	User        *User     `json:"user,omitempty"`
 	Time        time.Time `json:"time"`
+	Status      MsgStatus `json:"status,omitempty"`
+	ReplyTo     MsgID     `json:"reply_to,omitempty"`
+}
+
+func NewMsgIn(id MsgID, text string, attachments []string, t time.Time) *MsgIn {
+	return &MsgIn{ID: id, Text: text, Attachments: attachments, Time: t}
+}
+
+type MsgOut struct {
+	ID           MsgID      `json:"id"`
+	Text         string     `json:"text"`
+	Attachments  []string   `json:"attachments,omitempty"`
+	QuickReplies []string   `json:"quick_replies,omitempty"`
+	Locale       string     `json:"locale,omitempty"`
+	Origin       MsgOrigin  `json:"origin"`
+	User         *User      `json:"user,omitempty"`
+	Time         time.Time  `json:"time"`
+	Status       MsgStatus  `json:"status,omitempty"`
+	SentOn       *time.Time `json:"sent_on,omitempty"`
+	ModifiedOn   *time.Time `json:"modified_on,omitempty"`
 }
 
 func NewMsgOut(id MsgID, text string, attachments []string, origin MsgOrigin, user *User, t time.Time) *MsgOut {
@@ -49,15 +93,20 @@ func NewMsgOut(id MsgID, text string, attachments []string, origin MsgOrigin, us
 }
 
 type DBMsg struct {
-	ID          MsgID        `json:"id"`
-	Text        string       `json:"text"`
-	Attachments []string     `json:"attachments"`
-	Direction   MsgDirection `json:"direction"`
-	BroadcastID BroadcastID  `json:"broadcast_id"`
-	FlowID      FlowID       `json:"flow_id"`
-	TicketID    TicketID     `json:"ticket_id"`
-	CreatedByID UserID       `json:"created_by_id"`
-	CreatedOn   time.Time    `json:"created_on"`
+	ID           MsgID        `json:"id"`
+	Text         string       `json:"text"`
+	Attachments  []string     `json:"attachments"`
+	Direction    MsgDirection `json:"direction"`
+	Status       string       `json:"status"`
+	BroadcastID  BroadcastID  `json:"broadcast_id"`
+	FlowID       FlowID       `json:"flow_id"`
+	TicketID     TicketID     `json:"ticket_id"`
+	CreatedByID  UserID       `json:"created_by_id"`
+	QuickReplies []string     `json:"quick_replies"`
+	Locale       string       `json:"locale"`
+	CreatedOn    time.Time    `json:"created_on"`
+	ModifiedOn   time.Time    `json:"modified_on"`
+	SentOn       *time.Time   `json:"sent_on"`
 }
 
 func (m *DBMsg) ToMsgIn() *MsgIn {
@@ -65,7 +114,9 @@ func (m *DBMsg) ToMsgIn() *MsgIn {
 		panic("can only be called on an inbound message")
 	}
 
-	return NewMsgIn(m.ID, m.Text, m.CreatedOn)
+	msg := NewMsgIn(m.ID, m.Text, m.Attachments, m.CreatedOn)
+	msg.Status = dbStatuses[m.Status]
+	return msg
 }
 
 func (m *DBMsg) ToMsgOut(ctx context.Context, store Store) (*MsgOut, error) {
@@ -82,7 +133,13 @@ func (m *DBMsg) ToMsgOut(ctx context.Context, store Store) (*MsgOut, error) {
 		}
 	}
 
-	return NewMsgOut(m.ID, m.Text, m.Attachments, m.origin(), user, m.CreatedOn), nil
+	msg := NewMsgOut(m.ID, m.Text, m.Attachments, m.origin(), user, m.CreatedOn)
+	msg.QuickReplies = m.QuickReplies
+	msg.Locale = m.Locale
+	msg.Status = dbStatuses[m.Status]
+	msg.SentOn = m.SentOn
+	msg.ModifiedOn = &m.ModifiedOn
+	return msg, nil
 }
 
 func (m *DBMsg) origin() MsgOrigin {
@@ -96,17 +153,98 @@ func (m *DBMsg) origin() MsgOrigin {
 	return MsgOriginChat
 }
 
-const sqlSelectContactMessages = `
+// MsgCursor is a position in a contact's message history. Messages are ordered by time and then ID so that messages
+// created at the same time are never skipped or repeated when paging.
+type MsgCursor struct {
+	Time time.Time
+	ID   MsgID
+}
+
+// ParseMsgCursor parses a cursor previously encoded with String
+func ParseMsgCursor(s string) (*MsgCursor, error) {
+	d, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	var micros int64
+	var id MsgID
+	if _, err := fmt.Sscanf(string(d), "%d:%d", &micros, &id); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	return &MsgCursor{Time: time.UnixMicro(micros).UTC(), ID: id}, nil
+}
+
+// String encodes this cursor as an opaque string which can be given to clients
+func (c *MsgCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.Time.UnixMicro(), c.ID)))
+}
+
+// Cursor returns the position of this message in history
+func (m *DBMsg) Cursor() *MsgCursor {
+	return &MsgCursor{Time: m.CreatedOn, ID: m.ID}
+}
+
+const sqlSelectContactMessagesBefore = `
 SELECT row_to_json(r) FROM (
-    SELECT id, text, attachments, direction, broadcast_id, flow_id, ticket_id, created_by_id, created_on
+    SELECT id, text, attachments, direction, status, broadcast_id, flow_id, ticket_id, created_by_id, quick_replies, locale, created_on, modified_on, sent_on
       FROM msgs_msg 
-     WHERE contact_id = $1 AND msg_type = 'T' AND visibility IN ('V', 'A') AND created_on < $2
+     WHERE contact_id = $1 AND msg_type = 'T' AND visibility IN ('V', 'A') AND ($2::timestamptz IS NULL OR (created_on, id) < ($2, $3))
   ORDER BY created_on DESC, id DESC 
-     LIMIT $3
+     LIMIT $4
+) r`
+
+const sqlSelectContactMessagesAfter = `
+SELECT row_to_json(r) FROM (
+    SELECT id, text, attachments, direction, status, broadcast_id, flow_id, ticket_id, created_by_id, quick_replies, locale, created_on, modified_on, sent_on
+      FROM msgs_msg 
+     WHERE contact_id = $1 AND msg_type = 'T' AND visibility IN ('V', 'A') AND (created_on, id) > ($2, $3)
+  ORDER BY created_on, id 
+     LIMIT $4
 ) r`
 
-func LoadContactMessages(ctx context.Context, rt *runtime.Runtime, contactID ContactID, before time.Time, limit int) ([]*DBMsg, error) {
-	rows, err := rt.DB.QueryContext(ctx, sqlSelectContactMessages, contactID, before, limit)
+// LoadContactMessages loads up to limit messages for the given contact which come before the given cursor, or are the
+// most recent if cursor is nil, newest first. Also returns whether there are older messages.
+func LoadContactMessages(ctx context.Context, rt *runtime.Runtime, contactID ContactID, before *MsgCursor, limit int) ([]*DBMsg, bool, error) {
+	var t *time.Time
+	var id MsgID
+	if before != nil {
+		t, id = &before.Time, before.ID
+	}
+
+	// fetch an extra message to know if there are more
+	msgs, err := loadContactMessages(ctx, rt, sqlSelectContactMessagesBefore, contactID, t, id, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(msgs) > limit {
+		return msgs[:limit], true, nil
+	}
+	return msgs, false, nil
+}
+
+// LoadContactMessagesAfter loads up to limit messages for the given contact which come after the given cursor, e.g. to
+// catch up after reconnecting, newest first. Also returns whether there are newer messages.
+func LoadContactMessagesAfter(ctx context.Context, rt *runtime.Runtime, contactID ContactID, after *MsgCursor, limit int) ([]*DBMsg, bool, error) {
+	msgs, err := loadContactMessages(ctx, rt, sqlSelectContactMessagesAfter, contactID, after.Time, after.ID, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(msgs) > limit
+	if hasMore {
+		msgs = msgs[:limit]
+	}
+
+	slices.Reverse(msgs)
+
+	return msgs, hasMore, nil
+}
+
+func loadContactMessages(ctx context.Context, rt *runtime.Runtime, query string, args ...any) ([]*DBMsg, error) {
+	rows, err := rt.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("error querying contact messages: %w", err)
 	}
@@ -125,3 +263,58 @@ func LoadContactMessages(ctx context.Context, rt *runtime.Runtime, contactID Con
 
 	return msgs, nil
 }
+
+const sqlSelectMsgIDByUUID = `SELECT id FROM msgs_msg WHERE uuid = $1 AND channel_id = $2`
+
+// LoadMsgID loads the ID of the message with the given UUID on the given channel, returning NilMsgID if it doesn't exist
+func LoadMsgID(ctx context.Context, rt *runtime.Runtime, ch *Channel, uuid MsgUUID) (MsgID, error) {
+	var id MsgID
+	err := rt.DB.QueryRowContext(ctx, sqlSelectMsgIDByUUID, uuid, ch.ID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return NilMsgID, nil
+	} else if err != nil {
+		return NilMsgID, fmt.Errorf("error querying msg id: %w", err)
+	}
+	return id, nil
+}
+
+const sqlSelectUnreadContactMessages = `
+SELECT id 
+  FROM msgs_msg 
+ WHERE contact_id = $1 AND channel_id = $2 AND direction = 'O' AND msg_type = 'T' AND status IN ('W', 'S', 'D') AND (id = $3 OR created_on <= $4)
+ORDER BY created_on, id`
+
+// LoadUnreadMsgIDs loads the IDs of outgoing messages to the given contact on the given channel which have been sent but
+// not yet read, and which either match the given message ID or were created on or before the given time
+func LoadUnreadMsgIDs(ctx context.Context, rt *runtime.Runtime, ch *Channel, contactID ContactID, msgID MsgID, upTo time.Time) ([]MsgID, error) {
+	rows, err := rt.DB.QueryContext(ctx, sqlSelectUnreadContactMessages, contactID, ch.ID, msgID, upTo)
+	if err != nil {
+		return nil, fmt.Errorf("error querying unread messages: %w", err)
+	}
+	defer rows.Close()
+
+	ids := make([]MsgID, 0)
+
+	for rows.Next() {
+		var id MsgID
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning msg id: %w", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+const sqlSelectOutgoingMsgExists = `
+SELECT EXISTS(SELECT 1 FROM msgs_msg WHERE id = $1 AND contact_id = $2 AND channel_id = $3 AND direction = 'O')`
+
+// OutgoingMsgExists returns whether the given message was sent to the given contact on the given channel
+func OutgoingMsgExists(ctx context.Context, rt *runtime.Runtime, ch *Channel, contactID ContactID, msgID MsgID) (bool, error) {
+	var exists bool
+	if err := rt.DB.QueryRowContext(ctx, sqlSelectOutgoingMsgExists, msgID, contactID, ch.ID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("error querying outgoing message: %w", err)
+	}
+	return exists, nil
+}
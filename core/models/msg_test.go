@@ -10,6 +10,21 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func TestMsgCursor(t *testing.T) {
+	c := &models.MsgCursor{Time: time.Date(2024, 4, 5, 17, 12, 45, 123456000, time.UTC), ID: 1234}
+	assert.Equal(t, "MTcxMjMzNzE2NTEyMzQ1NjoxMjM0", c.String())
+
+	parsed, err := models.ParseMsgCursor("MTcxMjMzNzE2NTEyMzQ1NjoxMjM0")
+	assert.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	_, err = models.ParseMsgCursor("xyz")
+	assert.EqualError(t, err, "invalid cursor")
+
+	_, err = models.ParseMsgCursor("MTIzNA") // 1234
+	assert.EqualError(t, err, "invalid cursor")
+}
+
 func TestLoadContactMessages(t *testing.T) {
 	ctx, rt := testsuite.Runtime()
 
@@ -22,51 +37,69 @@ func TestLoadContactMessages(t *testing.T) {
 	bobID := testsuite.InsertContact(rt, orgID, "Bob")
 	bobURNID := testsuite.InsertURN(rt, orgID, bobID, "webchat:65vbbDAQCdPdEWlEhDGy4utO")
 
-	msgs, err := models.LoadContactMessages(ctx, rt, bobID, time.Now(), 10)
+	msgs, hasMore, err := models.LoadContactMessages(ctx, rt, bobID, nil, 10)
 	assert.NoError(t, err)
 	assert.Len(t, msgs, 0)
+	assert.False(t, hasMore)
 
-	t1 := time.Date(2024, 4, 5, 17, 12, 45, 123456789, time.UTC)
-	t2 := time.Date(2024, 4, 5, 17, 13, 45, 123456789, time.UTC)
-	t3 := time.Date(2024, 4, 5, 17, 14, 45, 123456789, time.UTC)
+	t1 := time.Date(2024, 4, 5, 17, 12, 45, 123456000, time.UTC)
+	t2 := time.Date(2024, 4, 5, 17, 13, 45, 123456000, time.UTC)
+	t3 := time.Date(2024, 4, 5, 17, 14, 45, 123456000, time.UTC)
 
 	msg1ID := testsuite.InsertIncomingMsg(rt, orgID, chanID, bobID, bobURNID, "Hello", t1)
 	msg2ID := testsuite.InsertOutgoingMsg(rt, orgID, chanID, bobID, bobURNID, "There", t2)
-	msg3ID := testsuite.InsertIncomingMsg(rt, orgID, chanID, bobID, bobURNID, "World", t3)
-	testsuite.InsertIncomingMsg(rt, orgID, chanID, annID, annURNID, "Hello", time.Date(2024, 4, 5, 17, 12, 45, 123456789, time.UTC))
+	msg3ID := testsuite.InsertOutgoingMsg(rt, orgID, chanID, bobID, bobURNID, "How", t2) // same time as previous
+	msg4ID := testsuite.InsertIncomingMsg(rt, orgID, chanID, bobID, bobURNID, "World", t3)
+	testsuite.InsertIncomingMsg(rt, orgID, chanID, annID, annURNID, "Hello", t1)
+
+	msgIDs := func(msgs []*models.DBMsg) []models.MsgID {
+		ids := make([]models.MsgID, len(msgs))
+		for i := range msgs {
+			ids[i] = msgs[i].ID
+		}
+		return ids
+	}
 
-	msgs, err = models.LoadContactMessages(ctx, rt, bobID, time.Now(), 10)
+	msgs, hasMore, err = models.LoadContactMessages(ctx, rt, bobID, nil, 10)
 	assert.NoError(t, err)
-	if assert.Len(t, msgs, 3) {
-		assert.Equal(t, msg3ID, msgs[0].ID)
+	assert.False(t, hasMore)
+	if assert.Len(t, msgs, 4) {
+		assert.Equal(t, msg4ID, msgs[0].ID)
 		assert.Equal(t, "World", msgs[0].Text)
 		assert.Equal(t, models.DirectionIn, msgs[0].Direction)
 
-		assert.Equal(t, msg2ID, msgs[1].ID)
-		assert.Equal(t, "There", msgs[1].Text)
+		assert.Equal(t, msg3ID, msgs[1].ID)
+		assert.Equal(t, "How", msgs[1].Text)
 		assert.Equal(t, models.DirectionOut, msgs[1].Direction)
-
-		assert.Equal(t, msg1ID, msgs[2].ID)
-		assert.Equal(t, "Hello", msgs[2].Text)
-		assert.Equal(t, models.DirectionIn, msgs[2].Direction)
 	}
 
-	msgs, err = models.LoadContactMessages(ctx, rt, bobID, t3, 10)
+	// page backwards through history two messages at a time
+	msgs, hasMore, err = models.LoadContactMessages(ctx, rt, bobID, nil, 2)
 	assert.NoError(t, err)
-	if assert.Len(t, msgs, 2) {
-		assert.Equal(t, "There", msgs[0].Text)
-		assert.Equal(t, "Hello", msgs[1].Text)
-	}
+	assert.Equal(t, []models.MsgID{msg4ID, msg3ID}, msgIDs(msgs))
+	assert.True(t, hasMore)
 
-	msgs, err = models.LoadContactMessages(ctx, rt, bobID, t3, 1)
+	// next page includes the message with the same time as the last message of the previous page
+	msgs, hasMore, err = models.LoadContactMessages(ctx, rt, bobID, msgs[1].Cursor(), 2)
 	assert.NoError(t, err)
-	if assert.Len(t, msgs, 1) {
-		assert.Equal(t, "There", msgs[0].Text)
-	}
+	assert.Equal(t, []models.MsgID{msg2ID, msg1ID}, msgIDs(msgs))
+	assert.False(t, hasMore)
 
-	msgs, err = models.LoadContactMessages(ctx, rt, bobID, t1, 10)
+	msgs, hasMore, err = models.LoadContactMessages(ctx, rt, bobID, msgs[1].Cursor(), 2)
 	assert.NoError(t, err)
 	assert.Len(t, msgs, 0)
+	assert.False(t, hasMore)
+
+	// page forwards from the first message
+	msgs, hasMore, err = models.LoadContactMessagesAfter(ctx, rt, bobID, &models.MsgCursor{Time: t1, ID: msg1ID}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.MsgID{msg3ID, msg2ID}, msgIDs(msgs))
+	assert.True(t, hasMore)
+
+	msgs, hasMore, err = models.LoadContactMessagesAfter(ctx, rt, bobID, msgs[0].Cursor(), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.MsgID{msg4ID}, msgIDs(msgs))
+	assert.False(t, hasMore)
 }
 
 func TestDMMsgToMsgInAndOut(t *testing.T) {
@@ -81,7 +114,7 @@ func TestDMMsgToMsgInAndOut(t *testing.T) {
 
 	msg1ID := testsuite.InsertIncomingMsg(rt, orgID, chanID, bobID, bobURNID, "Hello", time.Now())
 	msg2ID := testsuite.InsertOutgoingMsg(rt, orgID, chanID, bobID, bobURNID, "There", time.Now())
-	msgs, err := models.LoadContactMessages(ctx, rt, bobID, time.Now(), 10)
+	msgs, _, err := models.LoadContactMessages(ctx, rt, bobID, nil, 10)
 	require.NoError(t, err)
 	msg1 := msgs[1]
 	msg2 := msgs[0]
@@ -91,13 +124,129 @@ func TestDMMsgToMsgInAndOut(t *testing.T) {
 	defer store.Stop()
 
 	msg1In := msg1.ToMsgIn()
-	assert.Equal(t, models.NewMsgIn(msg1ID, "Hello", msg1.CreatedOn), msg1In)
+	assert.Equal(t, &models.MsgIn{ID: msg1ID, Text: "Hello", Time: msg1.CreatedOn, Status: models.MsgStatusHandled}, msg1In)
 
 	msg2Out, err := msg2.ToMsgOut(ctx, store)
 	assert.NoError(t, err)
-	assert.Equal(t, models.NewMsgOut(msg2ID, "There", nil, "chat", nil, msg2.CreatedOn), msg2Out)
+	assert.Equal(t, &models.MsgOut{ID: msg2ID, Text: "There", Origin: "chat", Time: msg2.CreatedOn, Status: models.MsgStatusQueued, ModifiedOn: &msg2.ModifiedOn}, msg2Out)
 
 	// can't call ToMsgIn on an outbound message and vice versa
 	assert.Panics(t, func() { msg2.ToMsgIn() })
 	assert.Panics(t, func() { msg1.ToMsgOut(ctx, store) })
 }
+
+func TestLoadUnreadMsgIDs(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.ResetDB()
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	chanID := testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame"})
+	bobID := testsuite.InsertContact(rt, orgID, "Bob")
+	bobURNID := testsuite.InsertURN(rt, orgID, bobID, "webchat:65vbbDAQCdPdEWlEhDGy4utO")
+
+	t1 := time.Date(2024, 4, 5, 17, 12, 45, 123456789, time.UTC)
+	t2 := time.Date(2024, 4, 5, 17, 13, 45, 123456789, time.UTC)
+	t3 := time.Date(2024, 4, 5, 17, 14, 45, 123456789, time.UTC)
+
+	msg1ID := testsuite.InsertOutgoingMsg(rt, orgID, chanID, bobID, bobURNID, "Hi", t1)
+	msg2ID := testsuite.InsertOutgoingMsg(rt, orgID, chanID, bobID, bobURNID, "How can I help", t2)
+	msg3ID := testsuite.InsertOutgoingMsg(rt, orgID, chanID, bobID, bobURNID, "Still there?", t3)
+	msg4ID := testsuite.InsertOutgoingMsg(rt, orgID, chanID, bobID, bobURNID, "Queued", t1)
+	testsuite.InsertIncomingMsg(rt, orgID, chanID, bobID, bobURNID, "Hello", t2)
+
+	_, err := rt.DB.Exec(`UPDATE msgs_msg SET status = 'W' WHERE id IN ($1, $2, $3)`, msg1ID, msg2ID, msg3ID)
+	require.NoError(t, err)
+
+	// messages to the same contact on other channels are excluded
+	otherChanID := testsuite.InsertChannel(rt, "0a3ca3a4-6c9a-4a6e-9f0e-5c4d1b2a3e4f", orgID, "CHP", "Other", "456", []string{"webchat"}, map[string]any{"secret": "sesame"})
+	testsuite.InsertOutgoingMsg(rt, orgID, otherChanID, bobID, bobURNID, "Elsewhere", t1)
+
+	ch, err := models.LoadChannel(ctx, rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9")
+	require.NoError(t, err)
+
+	ids, err := models.LoadUnreadMsgIDs(ctx, rt, ch, bobID, models.NilMsgID, t2)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.MsgID{msg1ID, msg2ID}, ids)
+
+	// messages which haven't been sent yet are excluded, even if asked for explicitly
+	ids, err = models.LoadUnreadMsgIDs(ctx, rt, ch, bobID, msg4ID, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.MsgID{}, ids)
+
+	ids, err = models.LoadUnreadMsgIDs(ctx, rt, ch, bobID, msg3ID, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.MsgID{msg3ID}, ids)
+
+	// read messages are excluded
+	_, err = rt.DB.Exec(`UPDATE msgs_msg SET status = 'R' WHERE id = $1`, msg1ID)
+	require.NoError(t, err)
+
+	ids, err = models.LoadUnreadMsgIDs(ctx, rt, ch, bobID, models.NilMsgID, t3)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.MsgID{msg2ID, msg3ID}, ids)
+}
+
+func TestLoadMsgID(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.ResetDB()
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	chanID := testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame"})
+	bobID := testsuite.InsertContact(rt, orgID, "Bob")
+	bobURNID := testsuite.InsertURN(rt, orgID, bobID, "webchat:65vbbDAQCdPdEWlEhDGy4utO")
+	msgID := testsuite.InsertIncomingMsg(rt, orgID, chanID, bobID, bobURNID, "Hello", time.Now())
+
+	ch, err := models.LoadChannel(ctx, rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9")
+	require.NoError(t, err)
+
+	var msgUUID models.MsgUUID
+	require.NoError(t, rt.DB.QueryRow(`SELECT uuid FROM msgs_msg WHERE id = $1`, msgID).Scan(&msgUUID))
+
+	id, err := models.LoadMsgID(ctx, rt, ch, msgUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, msgID, id)
+
+	// message that doesn't exist (yet)
+	id, err = models.LoadMsgID(ctx, rt, ch, "0191a4e4-b5f4-7e2a-9e5a-5d0e4c07b1a3")
+	assert.NoError(t, err)
+	assert.Equal(t, models.NilMsgID, id)
+}
+
+func TestOutgoingMsgExists(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.ResetDB()
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	chanID := testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame"})
+	otherChanID := testsuite.InsertChannel(rt, "0a3ca3a4-6c9a-4a6e-9f0e-5c4d1b2a3e4f", orgID, "CHP", "Other", "456", []string{"webchat"}, map[string]any{"secret": "sesame"})
+	bobID := testsuite.InsertContact(rt, orgID, "Bob")
+	bobURNID := testsuite.InsertURN(rt, orgID, bobID, "webchat:65vbbDAQCdPdEWlEhDGy4utO")
+	annID := testsuite.InsertContact(rt, orgID, "Ann")
+	annURNID := testsuite.InsertURN(rt, orgID, annID, "webchat:3xdF7KhyEiabBiCd3Cst3X28")
+
+	msg1ID := testsuite.InsertOutgoingMsg(rt, orgID, chanID, bobID, bobURNID, "Hi", time.Now())
+	msg2ID := testsuite.InsertIncomingMsg(rt, orgID, chanID, bobID, bobURNID, "Hello", time.Now())
+	msg3ID := testsuite.InsertOutgoingMsg(rt, orgID, chanID, annID, annURNID, "Hi", time.Now())
+	msg4ID := testsuite.InsertOutgoingMsg(rt, orgID, otherChanID, bobID, bobURNID, "Hi", time.Now())
+
+	ch, err := models.LoadChannel(ctx, rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		msgID  models.MsgID
+		exists bool
+	}{
+		{msg1ID, true},
+		{msg2ID, false}, // incoming
+		{msg3ID, false}, // other contact
+		{msg4ID, false}, // other channel
+		{12345678, false},
+	} {
+		exists, err := models.OutgoingMsgExists(ctx, rt, ch, bobID, tc.msgID)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.exists, exists, "exists mismatch for msg %d", tc.msgID)
+	}
+}
@@ -0,0 +1,148 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// how far ahead we look for the next opening or closing time
+const scheduleHorizon = 366
+
+// Schedule is the business hours of a channel during which someone is available to chat, e.g.
+//
+//	{"timezone": "Africa/Kigali", "hours": {"mon": ["08:00-12:00", "13:00-17:00"]}, "holidays": ["2024-12-25"]}
+type Schedule struct {
+	location *time.Location
+	hours    map[time.Weekday][][2]int // open and close minutes of each day
+	holidays []string
+}
+
+// Availability is whether someone is available to chat now, and when that next changes, if ever
+type Availability struct {
+	Online bool
+	Next   *time.Time
+}
+
+// OpensOn returns when the channel next opens if it's currently offline
+func (a *Availability) OpensOn() *time.Time {
+	if a.Online {
+		return nil
+	}
+	return a.Next
+}
+
+// ReadSchedule reads a schedule from its JSON representation
+func ReadSchedule(data []byte) (*Schedule, error) {
+	raw := &struct {
+		Timezone string              `json:"timezone"`
+		Hours    map[string][]string `json:"hours"`
+		Holidays []string            `json:"holidays"`
+	}{}
+	if err := json.Unmarshal(data, raw); err != nil {
+		return nil, fmt.Errorf("error unmarshaling schedule: %w", err)
+	}
+
+	location, err := time.LoadLocation(raw.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule timezone: %w", err)
+	}
+
+	s := &Schedule{location: location, hours: make(map[time.Weekday][][2]int, len(raw.Hours))}
+
+	for day, ranges := range raw.Hours {
+		weekday, ok := scheduleDays[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule day: %s", day)
+		}
+
+		for _, r := range ranges {
+			interval, err := parseHours(r)
+			if err != nil {
+				return nil, err
+			}
+			s.hours[weekday] = append(s.hours[weekday], interval)
+		}
+
+		slices.SortFunc(s.hours[weekday], func(a, b [2]int) int { return a[0] - b[0] })
+	}
+
+	for _, h := range raw.Holidays {
+		if _, err := time.Parse(time.DateOnly, h); err != nil {
+			return nil, fmt.Errorf("invalid schedule holiday: %s", h)
+		}
+		s.holidays = append(s.holidays, h)
+	}
+
+	return s, nil
+}
+
+// parses a range of hours like 08:00-17:00 into open and close minutes
+func parseHours(r string) ([2]int, error) {
+	opens, closes, _ := strings.Cut(r, "-")
+	openMins, err1 := parseMinutes(opens)
+	closeMins, err2 := parseMinutes(closes)
+
+	if err1 != nil || err2 != nil || openMins >= closeMins {
+		return [2]int{}, fmt.Errorf("invalid schedule hours: %s", r)
+	}
+	return [2]int{openMins, closeMins}, nil
+}
+
+func parseMinutes(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%02d:%02d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	return h*60 + m, nil
+}
+
+// Availability returns whether the channel is open at the given time, and when that next changes
+func (s *Schedule) Availability(now time.Time) *Availability {
+	now = now.In(s.location)
+
+	// walk through open periods in order, merging any that overlap or touch, until we find the first that hasn't ended
+	var opens, closes time.Time
+
+	for d := -1; d <= scheduleHorizon; d++ {
+		date := time.Date(now.Year(), now.Month(), now.Day()+d, 0, 0, 0, 0, s.location)
+		if slices.Contains(s.holidays, date.Format(time.DateOnly)) {
+			continue
+		}
+
+		for _, interval := range s.hours[date.Weekday()] {
+			start := time.Date(date.Year(), date.Month(), date.Day(), 0, interval[0], 0, 0, s.location)
+			end := time.Date(date.Year(), date.Month(), date.Day(), 0, interval[1], 0, 0, s.location)
+
+			if !closes.IsZero() && !start.After(closes) {
+				if end.After(closes) {
+					closes = end
+				}
+				continue
+			}
+			if closes.After(now) {
+				return newAvailability(now, opens, closes)
+			}
+
+			opens, closes = start, end
+		}
+	}
+
+	if closes.After(now) {
+		return newAvailability(now, opens, closes)
+	}
+	return &Availability{Online: false}
+}
+
+func newAvailability(now, opens, closes time.Time) *Availability {
+	if opens.After(now) {
+		return &Availability{Online: false, Next: &opens}
+	}
+	return &Availability{Online: true, Next: &closes}
+}
@@ -0,0 +1,79 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/chip/core/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedule(t *testing.T) {
+	kgl, _ := time.LoadLocation("Africa/Kigali")
+	at := func(d, h, m int) time.Time { return time.Date(2024, 12, d, h, m, 0, 0, kgl) }
+	ptr := func(t time.Time) *time.Time { return &t }
+
+	schedule, err := models.ReadSchedule([]byte(`{
+		"timezone": "Africa/Kigali",
+		"hours": {
+			"mon": ["13:00-17:00", "08:00-12:00"],
+			"tue": ["08:00-17:00"],
+			"wed": ["08:00-17:00"],
+			"thu": ["08:00-17:00"],
+			"fri": ["20:00-24:00"],
+			"sat": ["00:00-02:00"]
+		},
+		"holidays": ["2024-12-25"]
+	}`))
+	require.NoError(t, err)
+
+	tcs := []struct {
+		now      time.Time
+		expected *models.Availability
+	}{
+		{at(2, 7, 0), &models.Availability{Online: false, Next: ptr(at(2, 8, 0))}},    // monday morning
+		{at(2, 8, 0), &models.Availability{Online: true, Next: ptr(at(2, 12, 0))}},    // monday opening
+		{at(2, 12, 30), &models.Availability{Online: false, Next: ptr(at(2, 13, 0))}}, // monday lunch
+		{at(2, 17, 0), &models.Availability{Online: false, Next: ptr(at(3, 8, 0))}},   // monday closing
+		{at(5, 18, 0), &models.Availability{Online: false, Next: ptr(at(6, 20, 0))}},  // thursday evening
+		{at(6, 23, 0), &models.Availability{Online: true, Next: ptr(at(7, 2, 0))}},    // friday night runs into saturday
+		{at(7, 1, 0), &models.Availability{Online: true, Next: ptr(at(7, 2, 0))}},     // saturday early
+		{at(7, 9, 0), &models.Availability{Online: false, Next: ptr(at(9, 8, 0))}},    // weekend
+		{at(24, 18, 0), &models.Availability{Online: false, Next: ptr(at(26, 8, 0))}}, // christmas is a holiday
+		{at(2, 10, 0).UTC(), &models.Availability{Online: true, Next: ptr(at(2, 12, 0))}},
+	}
+
+	for _, tc := range tcs {
+		actual := schedule.Availability(tc.now)
+		assert.Equal(t, tc.expected.Online, actual.Online, "online mismatch for %s", tc.now)
+		if assert.NotNil(t, actual.Next, "next is nil for %s", tc.now) {
+			assert.True(t, tc.expected.Next.Equal(*actual.Next), "next mismatch for %s, got %s", tc.now, actual.Next)
+		}
+	}
+
+	assert.Nil(t, schedule.Availability(at(2, 9, 0)).OpensOn())
+	assert.True(t, at(3, 8, 0).Equal(*schedule.Availability(at(2, 18, 0)).OpensOn()))
+
+	// a schedule with no hours is never online
+	schedule, err = models.ReadSchedule([]byte(`{"timezone": "UTC"}`))
+	require.NoError(t, err)
+	assert.Equal(t, &models.Availability{Online: false}, schedule.Availability(at(2, 9, 0)))
+
+	// invalid schedules
+	_, err = models.ReadSchedule([]byte(`{"timezone": "Africa/Nowhere"}`))
+	assert.EqualError(t, err, "invalid schedule timezone: unknown time zone Africa/Nowhere")
+	_, err = models.ReadSchedule([]byte(`{"timezone": "UTC", "hours": {"xyz": ["08:00-17:00"]}}`))
+	assert.EqualError(t, err, "invalid schedule day: xyz")
+	_, err = models.ReadSchedule([]byte(`{"timezone": "UTC", "hours": {"mon": ["17:00-08:00"]}}`))
+	assert.EqualError(t, err, "invalid schedule hours: 17:00-08:00")
+	_, err = models.ReadSchedule([]byte(`{"timezone": "UTC", "hours": {"mon": ["08:00-25:00"]}}`))
+	assert.EqualError(t, err, "invalid schedule hours: 08:00-25:00")
+	_, err = models.ReadSchedule([]byte(`{"timezone": "UTC", "holidays": ["25/12/2024"]}`))
+	assert.EqualError(t, err, "invalid schedule holiday: 25/12/2024")
+
+	// channels without a schedule are always online
+	ch := &models.Channel{Config: map[string]any{}}
+	assert.Nil(t, ch.Schedule())
+	assert.Equal(t, &models.Availability{Online: true}, ch.Availability(at(2, 9, 0)))
+}
@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/gocommon/jsonx"
+)
+
+type MessageType string
+
+const (
+	MessageTypeOutbox     MessageType = "outbox"
+	MessageTypeOutboxItem MessageType = "outbox_item"
+	MessageTypeTyping     MessageType = "typing"
+	MessageTypeChatIn     MessageType = "chat_in"
+)
+
+// Message is an ephemeral notification about a chat which isn't queued, and is only useful to whichever instance
+// currently has a client for that chat
+type Message struct {
+	Type        MessageType        `json:"type"`
+	ChannelUUID models.ChannelUUID `json:"channel_uuid"`
+	ChatID      models.ChatID      `json:"chat_id"`
+	User        *models.User       `json:"user,omitempty"`
+	Msg         *models.MsgOut     `json:"msg,omitempty"`
+	Event       *models.ChatEvent  `json:"event,omitempty"`
+	MsgIn       *models.MsgIn      `json:"msg_in,omitempty"`
+}
+
+// Publish publishes the given message to all listeners on the given channel
+func Publish(rc redis.Conn, channel string, m *Message) error {
+	_, err := rc.Do("PUBLISH", channel, jsonx.MustMarshal(m))
+	return err
+}
+
+// Listener subscribes to a channel and calls a handler for each message received
+type Listener struct {
+	rp      *redis.Pool
+	channel string
+	handler func(*Message)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewListener creates a new listener for the given channel
+func NewListener(rp *redis.Pool, channel string, handler func(*Message)) *Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Listener{rp: rp, channel: channel, handler: handler, ctx: ctx, cancel: cancel}
+}
+
+func (l *Listener) Start() {
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+
+		// keep listening, reconnecting if necessary, until we're stopped
+		for {
+			l.listen()
+
+			select {
+			case <-l.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+func (l *Listener) Stop() {
+	l.cancel()
+	l.wg.Wait()
+}
+
+func (l *Listener) listen() {
+	log := l.log()
+
+	psc := redis.PubSubConn{Conn: l.rp.Get()}
+	defer psc.Close()
+
+	if err := psc.Subscribe(l.channel); err != nil {
+		log.Error("error subscribing", "error", err)
+		return
+	}
+
+	for {
+		switch v := psc.ReceiveContext(l.ctx).(type) {
+		case redis.Message:
+			m := &Message{}
+			if err := json.Unmarshal(v.Data, m); err != nil {
+				log.Error("error decoding message", "data", string(v.Data), "error", err)
+				continue
+			}
+
+			l.handler(m)
+		case error:
+			if l.ctx.Err() == nil {
+				log.Error("error receiving", "error", v)
+			}
+			return
+		}
+	}
+}
+
+func (l *Listener) log() *slog.Logger {
+	return slog.With("comp", "listener", "channel", l.channel)
+}
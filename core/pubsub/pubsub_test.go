@@ -0,0 +1,49 @@
+package pubsub_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/chip/core/pubsub"
+	"github.com/nyaruka/chip/testsuite"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPubSub(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetValkey()
+
+	var received []*pubsub.Message
+	var mutex sync.Mutex
+
+	listener := pubsub.NewListener(rt.RP, "chattest:notify", func(m *pubsub.Message) {
+		mutex.Lock()
+		received = append(received, m)
+		mutex.Unlock()
+	})
+	listener.Start()
+
+	time.Sleep(100 * time.Millisecond)
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	bob := &models.User{ID: 1, Email: "bob@nyaruka.com", Name: "Bob McFlows"}
+
+	err := pubsub.Publish(rc, "chattest:notify", &pubsub.Message{Type: pubsub.MessageTypeTyping, ChannelUUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9", ChatID: "65vbbDAQCdPdEWlEhDGy4utO", User: bob})
+	assert.NoError(t, err)
+	err = pubsub.Publish(rc, "chattest:other", &pubsub.Message{Type: pubsub.MessageTypeTyping, ChannelUUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9", ChatID: "3xdF7KhyEiabBiCd3Cst3X28"})
+	assert.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	listener.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	assert.Equal(t, []*pubsub.Message{{Type: pubsub.MessageTypeTyping, ChannelUUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9", ChatID: "65vbbDAQCdPdEWlEhDGy4utO", User: bob}}, received)
+}
@@ -0,0 +1,54 @@
+local allKey, readyKey, sentKey, inflightKey, retriesKey, ownersKey = KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5], KEYS[6]
+local keyBase, instanceID, now, maxRetries, window = ARGV[1], ARGV[2], ARGV[3], tonumber(ARGV[4]), tonumber(ARGV[5])
+
+local expired = redis.call("ZRANGE", inflightKey, "-inf", now, "BYSCORE")
+
+local result = {} -- triples of queue IDs, item IDs and whether item was retried or failed
+
+for i, member in ipairs(expired) do
+    redis.call("ZREM", inflightKey, member)
+
+    local outbox, itemID = string.match(member, "^(.+)/([^/]+)$")
+
+    -- if another instance has since taken this outbox, it will have sent the item again itself
+    if redis.call("HGET", ownersKey, outbox) == instanceID then
+        local retries = redis.call("HINCRBY", retriesKey, member, 1)
+
+        if retries > maxRetries then
+            local outboxKey = keyBase .. ":outbox:" .. outbox
+            local items = redis.call("LRANGE", outboxKey, 0, window - 1)
+
+            for j, item in ipairs(items) do
+                if cjson.decode(item)["id"] == itemID then
+                    -- remove the item from the outbox
+                    redis.call("LSET", outboxKey, j - 1, "__removed__")
+                    redis.call("LREM", outboxKey, 1, "__removed__")
+
+                    local nextItem = redis.call("LINDEX", outboxKey, 0)
+                    if nextItem == false then
+                        redis.call("ZREM", allKey, outbox)
+                    elseif j == 1 then
+                        redis.call("ZADD", allKey, cjson.decode(nextItem)["ts"], outbox)
+                    end
+
+                    table.insert(result, outbox)
+                    table.insert(result, itemID)
+                    table.insert(result, "failed")
+                    break
+                end
+            end
+
+            redis.call("HDEL", retriesKey, member)
+        else
+            table.insert(result, outbox)
+            table.insert(result, itemID)
+            table.insert(result, "retried")
+        end
+
+        -- send everything that's unacknowledged in this outbox again
+        redis.call("HDEL", sentKey, outbox)
+        redis.call("SADD", readyKey, outbox)
+    end
+end
+
+return result
@@ -0,0 +1,36 @@
+local allKey, outboxKey, ownersKey, sentKey, retriesKey = KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5]
+local keyBase, outbox = ARGV[1], ARGV[2]
+
+local purge = {}
+for i = 3, #ARGV do
+    purge[ARGV[i]] = true
+end
+
+-- any items still waiting to be acknowledged are waited on by the owning instance
+local owner = redis.call("HGET", ownersKey, outbox)
+
+-- mark the items to be removed, which may no longer all be there if some were acknowledged since they were read
+local items = redis.call("LRANGE", outboxKey, 0, -1)
+
+for i, item in ipairs(items) do
+    local itemID = cjson.decode(item)["id"]
+    if purge[itemID] then
+        redis.call("LSET", outboxKey, i - 1, "__removed__")
+        if owner then
+            redis.call("ZREM", keyBase .. ":inflight:" .. owner, outbox .. "/" .. itemID)
+        end
+        redis.call("HDEL", retriesKey, outbox .. "/" .. itemID)
+    end
+end
+
+redis.call("LREM", outboxKey, 0, "__removed__")
+
+-- anything left was added since the items were read, so will be sent again from the start
+redis.call("HDEL", sentKey, outbox)
+
+local nextItem = redis.call("LINDEX", outboxKey, 0)
+if nextItem == false then
+    redis.call("ZREM", allKey, outbox)
+else
+    redis.call("ZADD", allKey, cjson.decode(nextItem)["ts"], outbox)
+end
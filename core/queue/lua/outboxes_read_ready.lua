@@ -1,16 +1,30 @@
-local allKey, readyKey, keyBase = KEYS[1], KEYS[2], ARGV[1]
+local allKey, readyKey, sentKey, inflightKey, keyBase, window, deadline = KEYS[1], KEYS[2], KEYS[3], KEYS[4], ARGV[1], tonumber(ARGV[2]), ARGV[3]
 
 local outboxes = redis.call("ZINTER", 2, allKey, readyKey)
 
 local result = {} -- pairs of queue IDs and items
 
 for i, outbox in ipairs(outboxes) do
-    local item = redis.call("LINDEX", keyBase .. ":outbox:" .. outbox, 0)
+    -- items before this position have already been sent and are waiting to be acknowledged
+    local sent = tonumber(redis.call("HGET", sentKey, outbox) or "0")
 
-    table.insert(result, outbox)
-    table.insert(result, item)
+    local items = redis.call("LRANGE", keyBase .. ":outbox:" .. outbox, sent, window - 1)
 
-    redis.call("SREM", readyKey, outbox)
+    for j, item in ipairs(items) do
+        table.insert(result, outbox)
+        table.insert(result, item)
+
+        -- record when we'll give up waiting for this item to be acknowledged
+        redis.call("ZADD", inflightKey, deadline, outbox .. "/" .. cjson.decode(item)["id"])
+    end
+
+    sent = sent + #items
+    redis.call("HSET", sentKey, outbox, sent)
+
+    -- if the window is now full, we can't send anything more until items are acknowledged
+    if sent >= window then
+        redis.call("SREM", readyKey, outbox)
+    end
 end
 
-return result
\ No newline at end of file
+return result
@@ -1,34 +1,60 @@
-local allKey, outboxKey, readyKey, outbox, itemID = KEYS[1], KEYS[2], KEYS[3], ARGV[1], ARGV[2]
+local allKey, outboxKey, ownersKey, sentKey, retriesKey = KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5]
+local keyBase, outbox, itemID, window = ARGV[1], ARGV[2], ARGV[3], tonumber(ARGV[4])
 
-local thisItem = redis.call("LINDEX", outboxKey, 0)
-if thisItem == false then
+-- any item that's been sent will be in the first window of items
+local items = redis.call("LRANGE", outboxKey, 0, window - 1)
+if #items == 0 then
     return {"empty"}
 end
 
--- check that the id of the item we're removing matches the one we were given
-local item = cjson.decode(thisItem)
-if item["id"] ~= itemID then
-    return {"wrong-id", item["id"]}
+-- find the item with the id we were given, which may not be the oldest if acks arrive out of order
+local index = nil
+for i, item in ipairs(items) do
+    if cjson.decode(item)["id"] == itemID then
+        index = i
+        break
+    end
+end
+if index == nil then
+    return {"wrong-id"}
 end
 
 -- remove the item from the outbox
-redis.call("LTRIM", outboxKey, 1, -1)
+redis.call("LSET", outboxKey, index - 1, "__removed__")
+redis.call("LREM", outboxKey, 1, "__removed__")
+
+-- and stop waiting for it to be acknowledged, which the owning instance does as it's the one which sent it
+local owner = redis.call("HGET", ownersKey, outbox)
+if owner then
+    redis.call("ZREM", keyBase .. ":inflight:" .. owner, outbox .. "/" .. itemID)
+end
+redis.call("HDEL", retriesKey, outbox .. "/" .. itemID)
+
+local sent = tonumber(redis.call("HGET", sentKey, outbox) or "0")
+if index <= sent then
+    sent = sent - 1
+end
 
 -- now check if there are any more items in the outbox
-local nextItem = redis.call("LINDEX", outboxKey, 0)
-local hasMore = false
+local remaining = redis.call("LLEN", outboxKey)
 
-if nextItem == false then
+if remaining == 0 then
     -- nothing more in the outbox for this chat so take it out of the master set
     redis.call("ZREM", allKey, outbox)
+    redis.call("HDEL", sentKey, outbox)
 else
-    -- update the score of this outbox to the timestamp of its new oldest item
-    local item = cjson.decode(nextItem)
-    redis.call("ZADD", allKey, item["ts"], outbox)
-    hasMore = true
+    if index == 1 then
+        -- update the score of this outbox to the timestamp of its new oldest item
+        local item = cjson.decode(redis.call("LINDEX", outboxKey, 0))
+        redis.call("ZADD", allKey, item["ts"], outbox)
+    end
+
+    redis.call("HSET", sentKey, outbox, sent)
 end
 
--- put this outbox back in the ready set
-redis.call("SADD", readyKey, outbox)
+-- put this outbox back in its owner's ready set
+if owner then
+    redis.call("SADD", keyBase .. ":ready:" .. owner, outbox)
+end
 
-return {"success", tostring(hasMore)}
\ No newline at end of file
+return {"success", tostring(remaining > sent), owner or ""}
@@ -0,0 +1,34 @@
+local readyKey, ownersKey, sentKey, instancesKey = KEYS[1], KEYS[2], KEYS[3], KEYS[4]
+local keyBase, outbox, instanceID = ARGV[1], ARGV[2], ARGV[3]
+
+redis.call("SADD", instancesKey, instanceID)
+
+local owner = redis.call("HGET", ownersKey, outbox)
+
+-- if we already own this outbox, items we've sent have also gone to our other clients so nothing needs resending
+if owner == instanceID then
+    return
+end
+
+redis.call("HSET", ownersKey, outbox, instanceID)
+
+if owner == false then
+    -- nobody was connected so send everything unacknowledged again
+    redis.call("HDEL", sentKey, outbox)
+else
+    -- take over from the previous owner, including waiting for the items it's already sent
+    local prefix = outbox .. "/"
+    local oldInflightKey = keyBase .. ":inflight:" .. owner
+    local inflight = redis.call("ZRANGE", oldInflightKey, 0, -1, "WITHSCORES")
+
+    for i = 1, #inflight, 2 do
+        if string.sub(inflight[i], 1, #prefix) == prefix then
+            redis.call("ZREM", oldInflightKey, inflight[i])
+            redis.call("ZADD", keyBase .. ":inflight:" .. instanceID, inflight[i + 1], inflight[i])
+        end
+    end
+
+    redis.call("SREM", keyBase .. ":ready:" .. owner, outbox)
+end
+
+redis.call("SADD", readyKey, outbox)
@@ -0,0 +1,34 @@
+local readyKey, ownersKey, sentKey, instancesKey = KEYS[1], KEYS[2], KEYS[3], KEYS[4]
+local keyBase, outbox, instanceID = ARGV[1], ARGV[2], ARGV[3]
+
+redis.call("SREM", instancesKey, instanceID)
+redis.call("SREM", readyKey, outbox)
+
+-- nothing more to do if another instance owns this outbox
+if redis.call("HGET", ownersKey, outbox) ~= instanceID then
+    return false
+end
+
+-- if another instance still has clients for this chat, hand the outbox over to it, including waiting for the items
+-- we've already sent
+local next = redis.call("SRANDMEMBER", instancesKey)
+if next then
+    local prefix = outbox .. "/"
+    local inflightKey = keyBase .. ":inflight:" .. instanceID
+    local inflight = redis.call("ZRANGE", inflightKey, 0, -1, "WITHSCORES")
+
+    for i = 1, #inflight, 2 do
+        if string.sub(inflight[i], 1, #prefix) == prefix then
+            redis.call("ZREM", inflightKey, inflight[i])
+            redis.call("ZADD", keyBase .. ":inflight:" .. next, inflight[i + 1], inflight[i])
+        end
+    end
+
+    redis.call("HSET", ownersKey, outbox, next)
+    redis.call("SADD", keyBase .. ":ready:" .. next, outbox)
+    return next
+end
+
+redis.call("HDEL", ownersKey, outbox)
+redis.call("HDEL", sentKey, outbox)
+return false
@@ -3,29 +3,52 @@ package queue
 import (
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/chip/core/pubsub"
 	"github.com/nyaruka/gocommon/jsonx"
 )
 
 //go:embed lua/outboxes_read_ready.lua
 var outboxesReadReady string
-var outboxesReadReadyScript = redis.NewScript(2, outboxesReadReady)
+var outboxesReadReadyScript = redis.NewScript(4, outboxesReadReady)
+
+//go:embed lua/outboxes_set_ready.lua
+var outboxesSetReady string
+var outboxesSetReadyScript = redis.NewScript(4, outboxesSetReady)
+
+//go:embed lua/outboxes_unset_ready.lua
+var outboxesUnsetReady string
+var outboxesUnsetReadyScript = redis.NewScript(4, outboxesUnsetReady)
 
 //go:embed lua/outboxes_record_sent.lua
 var outboxesRecordSent string
-var outboxesRecordSentScript = redis.NewScript(3, outboxesRecordSent)
+var outboxesRecordSentScript = redis.NewScript(5, outboxesRecordSent)
+
+//go:embed lua/outboxes_expire_sent.lua
+var outboxesExpireSent string
+var outboxesExpireSentScript = redis.NewScript(6, outboxesExpireSent)
+
+//go:embed lua/outboxes_purge.lua
+var outboxesPurge string
+var outboxesPurgeScript = redis.NewScript(5, outboxesPurge)
+
+// ErrItemNotFound is returned when recording an item as sent which isn't in the outbox, e.g. it's already been acknowledged
+var ErrItemNotFound = errors.New("item not found in outbox")
 
 type ItemID string
 
 // Item wraps things that can be put in an outbox
 type Item struct {
-	ID  ItemID         `json:"id"`
-	TS  int64          `json:"ts"`
-	Msg *models.MsgOut `json:"msg"`
+	ID    ItemID            `json:"id"`
+	TS    int64             `json:"ts"`
+	Msg   *models.MsgOut    `json:"msg,omitempty"`
+	Event *models.ChatEvent `json:"event,omitempty"`
 }
 
 // Outbox is channel + chat ID pair that we can send to
@@ -46,41 +69,111 @@ func decodeOutbox(id string) Outbox {
 type Outboxes struct {
 	KeyBase    string
 	InstanceID string
+	Window     int           // max number of unacknowledged items per outbox, defaults to 1
+	Timeout    time.Duration // how long to wait for an item to be acknowledged before sending it again
+	MaxRetries int           // how many times an unacknowledged item is sent again before it's failed
 }
 
-// SetReady records that this instance is ready to send messages to the given chat id
+// SetReady records whether this instance has clients for the given chat id. Each outbox has a single owning instance
+// which sends its items and forwards them to the other instances with clients. Readying an outbox makes this instance
+// its owner, taking over any items the previous owner is waiting to have acknowledged, and if it had no owner, any items
+// which were previously sent but never acknowledged will be sent again. Unreadying an outbox that this instance owns
+// hands it to another instance with clients if there is one.
 func (o *Outboxes) SetReady(rc redis.Conn, ch *models.Channel, chatID models.ChatID, ready bool) error {
 	outbox := Outbox{ch.UUID, chatID}
 
-	var err error
 	if ready {
-		_, err = rc.Do("SADD", o.readyKey(), outbox.String())
-	} else {
-		_, err = rc.Do("SREM", o.readyKey(), outbox.String())
+		_, err := outboxesSetReadyScript.Do(rc, o.readyKey(), o.ownersKey(), o.sentKey(), o.instancesKey(outbox), o.KeyBase, outbox.String(), o.InstanceID)
+		return err
 	}
-	return err
+
+	next, err := redis.String(outboxesUnsetReadyScript.Do(rc, o.readyKey(), o.ownersKey(), o.sentKey(), o.instancesKey(outbox), o.KeyBase, outbox.String(), o.InstanceID))
+	if err == redis.ErrNil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// let the new owner know it has an outbox to send from
+	return pubsub.Publish(rc, o.notifyKey(next), &pubsub.Message{Type: pubsub.MessageTypeOutbox, ChannelUUID: ch.UUID, ChatID: chatID})
 }
 
-// AddMessage adds a message to the outbox for the given chat id
+// AddMessage adds a message to the outbox for the given chat id, and notifies the owning instance if there is one
 func (o *Outboxes) AddMessage(rc redis.Conn, ch *models.Channel, chatID models.ChatID, m *models.MsgOut) error {
+	return o.add(rc, ch, chatID, &Item{ID: ItemID(fmt.Sprintf("m%d", m.ID)), TS: m.Time.UnixMilli(), Msg: m})
+}
+
+// AddEvent adds a chat event to the outbox for the given chat id, and notifies the owning instance if there is one
+func (o *Outboxes) AddEvent(rc redis.Conn, ch *models.Channel, chatID models.ChatID, e *models.ChatEvent) error {
+	return o.add(rc, ch, chatID, &Item{ID: ItemID(fmt.Sprintf("e%s", e.UUID)), TS: e.Time.UnixMilli(), Event: e})
+}
+
+func (o *Outboxes) add(rc redis.Conn, ch *models.Channel, chatID models.ChatID, item *Item) error {
 	outbox := Outbox{ch.UUID, chatID}
-	item := &Item{ID: ItemID(fmt.Sprintf("m%d", m.ID)), TS: m.Time.UnixMilli(), Msg: m}
 
 	rc.Send("MULTI")
 	rc.Send("RPUSH", o.outboxKey(outbox), jsonx.MustMarshal(item))
-	rc.Send("ZADD", o.allKey(), "NX", m.Time.UnixMilli(), outbox.String()) // update only if we're first message
-	_, err := rc.Do("EXEC")
-	return err
+	rc.Send("ZADD", o.allKey(), "NX", item.TS, outbox.String()) // update only if we're first item
+	rc.Send("HGET", o.ownersKey(), outbox.String())
+	results, err := redis.Values(rc.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+
+	if owner, _ := redis.String(results[2], nil); owner != "" {
+		return pubsub.Publish(rc, o.notifyKey(owner), &pubsub.Message{Type: pubsub.MessageTypeOutbox, ChannelUUID: ch.UUID, ChatID: chatID})
+	}
+	return nil
+}
+
+// Notify publishes the given message to every instance with clients for the given chat, returning false if there
+// aren't any
+func (o *Outboxes) Notify(rc redis.Conn, ch *models.Channel, chatID models.ChatID, m *pubsub.Message) (bool, error) {
+	instances, err := redis.Strings(rc.Do("SMEMBERS", o.instancesKey(Outbox{ch.UUID, chatID})))
+	if err != nil {
+		return false, err
+	}
+
+	for _, instance := range instances {
+		if err := pubsub.Publish(rc, o.notifyKey(instance), m); err != nil {
+			return false, err
+		}
+	}
+	return len(instances) > 0, nil
 }
 
-// ReadReady returns the oldest item for each outbox that this instance is ready to send for
-func (o *Outboxes) ReadReady(rc redis.Conn) (map[Outbox]*Item, error) {
-	pairs, err := redis.ByteSlices(outboxesReadReadyScript.Do(rc, o.allKey(), o.readyKey(), o.KeyBase))
+// Forward publishes the given message to every other instance with clients for the given outbox, which is how the
+// owning instance passes on the items it sends
+func (o *Outboxes) Forward(rc redis.Conn, outbox Outbox, m *pubsub.Message) error {
+	instances, err := redis.Strings(rc.Do("SMEMBERS", o.instancesKey(outbox)))
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		if instance != o.InstanceID {
+			if err := pubsub.Publish(rc, o.notifyKey(instance), m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// NotifyChannel returns the pub/sub channel on which this instance is notified about the outboxes it owns
+func (o *Outboxes) NotifyChannel() string {
+	return o.notifyKey(o.InstanceID)
+}
+
+// ReadReady returns the next unsent items, in order, for each outbox that this instance is ready to send for, and
+// records them as sent. Only as many items are returned as fit in the window of unacknowledged items.
+func (o *Outboxes) ReadReady(rc redis.Conn) (map[Outbox][]*Item, error) {
+	pairs, err := redis.ByteSlices(outboxesReadReadyScript.Do(rc, o.allKey(), o.readyKey(), o.sentKey(), o.inflightKey(), o.KeyBase, o.window(), time.Now().Add(o.Timeout).UnixMilli()))
 	if err != nil && err != redis.ErrNil {
 		return nil, err
 	}
 
-	ready := make(map[Outbox]*Item, len(pairs)/2)
+	ready := make(map[Outbox][]*Item)
 	for i := 0; i < len(pairs); i += 2 {
 		outbox := string(pairs[i])
 		itemJSON := pairs[i+1]
@@ -90,32 +183,138 @@ func (o *Outboxes) ReadReady(rc redis.Conn) (map[Outbox]*Item, error) {
 			return nil, fmt.Errorf("error decoding item %s: %v", itemJSON, err)
 		}
 
-		ready[decodeOutbox(outbox)] = item
+		box := decodeOutbox(outbox)
+		ready[box] = append(ready[box], item)
 	}
 
 	return ready, nil
 }
 
+// RecordSent removes the given item from the outbox once it's been acknowledged, which may be out of order, and returns
+// whether this instance has more items waiting to be sent. If the outbox is owned by another instance, that instance
+// is notified instead.
 func (o *Outboxes) RecordSent(rc redis.Conn, ch *models.Channel, chatID models.ChatID, itemID ItemID) (bool, error) {
 	outbox := Outbox{ch.UUID, chatID}
 
-	result, err := redis.Strings(outboxesRecordSentScript.Do(rc, o.allKey(), o.outboxKey(outbox), o.readyKey(), outbox.String(), itemID))
+	result, err := redis.Strings(outboxesRecordSentScript.Do(rc, o.allKey(), o.outboxKey(outbox), o.ownersKey(), o.sentKey(), o.retriesKey(), o.KeyBase, outbox.String(), itemID, o.window()))
 	if err != nil {
 		return false, err
 	}
-	if result[0] == "empty" {
-		return false, fmt.Errorf("outbox empty for chat %s", chatID)
+	if result[0] == "empty" || result[0] == "wrong-id" {
+		return false, ErrItemNotFound
 	}
-	if result[0] == "wrong-id" {
-		return false, fmt.Errorf("expected item id %s in outbox, found %s", itemID, result[1])
+
+	hasMore, owner := result[1] == "true", result[2]
+
+	if hasMore && owner != "" && owner != o.InstanceID {
+		return false, pubsub.Publish(rc, o.notifyKey(owner), &pubsub.Message{Type: pubsub.MessageTypeOutbox, ChannelUUID: ch.UUID, ChatID: chatID})
 	}
-	return result[1] == "true", nil
+	return hasMore && owner == o.InstanceID, nil
+}
+
+// ExpireSent finds sent items which haven't been acknowledged by the given time and makes their outboxes ready so that
+// they're sent again. Items which have already been sent again the max number of times are instead removed from their
+// outboxes and returned as failed. Returns whether any outboxes were made ready again.
+func (o *Outboxes) ExpireSent(rc redis.Conn, now time.Time) (bool, map[Outbox][]ItemID, error) {
+	triples, err := redis.Strings(outboxesExpireSentScript.Do(rc, o.allKey(), o.readyKey(), o.sentKey(), o.inflightKey(), o.retriesKey(), o.ownersKey(), o.KeyBase, o.InstanceID, now.UnixMilli(), o.MaxRetries, o.window()))
+	if err != nil && err != redis.ErrNil {
+		return false, nil, err
+	}
+
+	failed := make(map[Outbox][]ItemID)
+	for i := 0; i < len(triples); i += 3 {
+		if triples[i+2] == "failed" {
+			outbox := decodeOutbox(triples[i])
+			failed[outbox] = append(failed[outbox], ItemID(triples[i+1]))
+		}
+	}
+
+	return len(triples) > 0, failed, nil
+}
+
+// ReadStale returns all outboxes whose oldest item was queued before the given time
+func (o *Outboxes) ReadStale(rc redis.Conn, before time.Time) ([]Outbox, error) {
+	ids, err := redis.Strings(rc.Do("ZRANGE", o.allKey(), "-inf", fmt.Sprintf("(%d", before.UnixMilli()), "BYSCORE"))
+	if err != nil {
+		return nil, err
+	}
+
+	stale := make([]Outbox, len(ids))
+	for i, id := range ids {
+		stale[i] = decodeOutbox(id)
+	}
+	return stale, nil
+}
+
+// ReadAll returns all items in the given outbox without removing them
+func (o *Outboxes) ReadAll(rc redis.Conn, outbox Outbox) ([]*Item, error) {
+	itemsJSON, err := redis.ByteSlices(rc.Do("LRANGE", o.outboxKey(outbox), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*Item, len(itemsJSON))
+	for i, itemJSON := range itemsJSON {
+		items[i] = &Item{}
+		if err := json.Unmarshal(itemJSON, items[i]); err != nil {
+			return nil, fmt.Errorf("error decoding item %s: %v", itemJSON, err)
+		}
+	}
+	return items, nil
+}
+
+// Purge removes the given items, e.g. as read by ReadAll, from the given outbox and forgets their retry counts. Items
+// added to the outbox since are kept.
+func (o *Outboxes) Purge(rc redis.Conn, outbox Outbox, items []*Item) error {
+	args := redis.Args{}.Add(o.allKey(), o.outboxKey(outbox), o.ownersKey(), o.sentKey(), o.retriesKey(), o.KeyBase, outbox.String())
+	for _, item := range items {
+		args = args.Add(item.ID)
+	}
+
+	_, err := outboxesPurgeScript.Do(rc, args...)
+	return err
+}
+
+func (o *Outboxes) window() int {
+	if o.Window > 0 {
+		return o.Window
+	}
+	return 1
 }
 
 func (o *Outboxes) readyKey() string {
 	return fmt.Sprintf("%s:ready:%s", o.KeyBase, o.InstanceID)
 }
 
+func (o *Outboxes) ownersKey() string {
+	return fmt.Sprintf("%s:owners", o.KeyBase)
+}
+
+// instances which have clients for an outbox
+func (o *Outboxes) instancesKey(box Outbox) string {
+	return fmt.Sprintf("%s:instances:%s", o.KeyBase, box)
+}
+
+// notifications for an instance are published to a channel with the same name as its ready set
+func (o *Outboxes) notifyKey(instanceID string) string {
+	return fmt.Sprintf("%s:ready:%s", o.KeyBase, instanceID)
+}
+
+// number of items at the head of each outbox that have been sent but not yet acknowledged
+func (o *Outboxes) sentKey() string {
+	return fmt.Sprintf("%s:sent", o.KeyBase)
+}
+
+// deadlines by which sent items must be acknowledged
+func (o *Outboxes) inflightKey() string {
+	return fmt.Sprintf("%s:inflight:%s", o.KeyBase, o.InstanceID)
+}
+
+// number of times each sent item has been sent again
+func (o *Outboxes) retriesKey() string {
+	return fmt.Sprintf("%s:retries", o.KeyBase)
+}
+
 func (o *Outboxes) allKey() string {
 	return fmt.Sprintf("%s:outboxes", o.KeyBase)
 }
@@ -123,3 +322,8 @@ func (o *Outboxes) allKey() string {
 func (o *Outboxes) outboxKey(box Outbox) string {
 	return fmt.Sprintf("%s:outbox:%s", o.KeyBase, box)
 }
+
+// sent items are identified in the inflight and retries keys by their outbox and item ID
+func sentMember(outbox Outbox, itemID ItemID) string {
+	return fmt.Sprintf("%s/%s", outbox, itemID)
+}
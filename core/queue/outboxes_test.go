@@ -1,14 +1,21 @@
 package queue_test
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/chip/core/pubsub"
 	"github.com/nyaruka/chip/core/queue"
 	"github.com/nyaruka/chip/testsuite"
 	"github.com/nyaruka/vkutil/assertvk"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/maps"
 )
 
@@ -68,16 +75,24 @@ func TestOutboxes(t *testing.T) {
 	err = o.SetReady(rc, ch, "itlu4O6ZE4ZZc07Y5rHxcLoQ", true)
 	assert.NoError(t, err)
 	assertvk.SMembers(t, rc, "chattest:ready:foo1", []string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", "itlu4O6ZE4ZZc07Y5rHxcLoQ@8291264a-4581-4d12-96e5-e9fcfa6e68d9"})
+	assertvk.HGetAll(t, rc, "chattest:owners", map[string]string{
+		"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "foo1",
+		"itlu4O6ZE4ZZc07Y5rHxcLoQ@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "foo1",
+	})
 
-	// reading should now give us their oldest messages
+	// reading should now give us their oldest messages (default window is 1)
 	ready, err = o.ReadReady(rc)
 	assert.NoError(t, err)
 	assert.ElementsMatch(t, []queue.Outbox{{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "65vbbDAQCdPdEWlEhDGy4utO"}, {"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "itlu4O6ZE4ZZc07Y5rHxcLoQ"}}, maps.Keys(ready))
-	assert.Equal(t, queue.ItemID("m101"), ready[queue.Outbox{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "65vbbDAQCdPdEWlEhDGy4utO"}].ID)
-	assert.Equal(t, queue.ItemID("m105"), ready[queue.Outbox{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "itlu4O6ZE4ZZc07Y5rHxcLoQ"}].ID)
+	assert.Equal(t, []queue.ItemID{"m101"}, itemIDs(ready[queue.Outbox{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "65vbbDAQCdPdEWlEhDGy4utO"}]))
+	assert.Equal(t, []queue.ItemID{"m105"}, itemIDs(ready[queue.Outbox{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "itlu4O6ZE4ZZc07Y5rHxcLoQ"}]))
 
-	// and remove them from the instance's ready set
+	// and remove them from the instance's ready set as their windows are full
 	assertvk.SMembers(t, rc, "chattest:ready:foo1", []string{})
+	assertvk.HGetAll(t, rc, "chattest:sent", map[string]string{
+		"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "1",
+		"itlu4O6ZE4ZZc07Y5rHxcLoQ@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "1",
+	})
 
 	// nothing actual removed from any of the outboxes
 	assertvk.LLen(t, rc, "chattest:outbox:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", 3)
@@ -107,9 +122,573 @@ func TestOutboxes(t *testing.T) {
 
 	// try recording sent for a chat with an empty outbox
 	_, err = o.RecordSent(rc, ch, "A0UGLTWLLs59CrFzj6VpvMlG", "m101")
-	assert.EqualError(t, err, "outbox empty for chat A0UGLTWLLs59CrFzj6VpvMlG")
+	assert.Equal(t, queue.ErrItemNotFound, err)
 
 	// try recording sent with an incorrect message ID
 	_, err = o.RecordSent(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", "m999")
-	assert.EqualError(t, err, "expected item id m999 in outbox, found m102")
+	assert.Equal(t, queue.ErrItemNotFound, err)
+
+	// outboxes with items queued before 13:05 are stale
+	stale, err := o.ReadStale(rc, time.Date(2024, 1, 30, 13, 5, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.Outbox{{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "65vbbDAQCdPdEWlEhDGy4utO"}}, stale)
+
+	stale, err = o.ReadStale(rc, time.Date(2024, 1, 30, 13, 10, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.Outbox{{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "65vbbDAQCdPdEWlEhDGy4utO"}, {"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "itlu4O6ZE4ZZc07Y5rHxcLoQ"}}, stale)
+
+	// reading all items in an outbox doesn't remove them
+	items, err := o.ReadAll(rc, queue.Outbox{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "65vbbDAQCdPdEWlEhDGy4utO"})
+	assert.NoError(t, err)
+	if assert.Len(t, items, 2) {
+		assert.Equal(t, queue.ItemID("m102"), items[0].ID)
+		assert.Equal(t, "how can I help", items[0].Msg.Text)
+		assert.Equal(t, queue.ItemID("m104"), items[1].ID)
+	}
+	assertvk.LLen(t, rc, "chattest:outbox:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", 2)
+
+	// a new item is added before they're purged
+	err = o.AddMessage(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", models.NewMsgOut(106, "still there?", nil, models.MsgOriginChat, bob, time.Date(2024, 1, 30, 13, 15, 0, 0, time.UTC)))
+	assert.NoError(t, err)
+
+	// purging removes only the items that were read
+	err = o.Purge(rc, queue.Outbox{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "65vbbDAQCdPdEWlEhDGy4utO"}, items)
+	assert.NoError(t, err)
+
+	assertvk.LGetAll(t, rc, "chattest:outbox:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", []string{
+		`{"id":"m106","ts":1706620500000,"msg":{"id":106,"text":"still there?","origin":"chat","user":{"id":1,"email":"bob@nyaruka.com","name":"Bob McFlows"},"time":"2024-01-30T13:15:00Z"}}`,
+	})
+	assertvk.ZGetAll(t, rc, "chattest:outboxes", map[string]float64{
+		"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": 1706620500000,
+		"3xdF7KhyEiabBiCd3Cst3X28@8291264a-4581-4d12-96e5-e9fcfa6e68d9": 1706621520000,
+		"itlu4O6ZE4ZZc07Y5rHxcLoQ@8291264a-4581-4d12-96e5-e9fcfa6e68d9": 1706619960000,
+	})
+
+	// purging the remaining item removes the outbox
+	items, err = o.ReadAll(rc, queue.Outbox{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "65vbbDAQCdPdEWlEhDGy4utO"})
+	assert.NoError(t, err)
+	assert.NoError(t, o.Purge(rc, queue.Outbox{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "65vbbDAQCdPdEWlEhDGy4utO"}, items))
+
+	assertvk.LLen(t, rc, "chattest:outbox:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", 0)
+	assertvk.ZGetAll(t, rc, "chattest:outboxes", map[string]float64{
+		"3xdF7KhyEiabBiCd3Cst3X28@8291264a-4581-4d12-96e5-e9fcfa6e68d9": 1706621520000,
+		"itlu4O6ZE4ZZc07Y5rHxcLoQ@8291264a-4581-4d12-96e5-e9fcfa6e68d9": 1706619960000,
+	})
+
+	// reading again gives us nothing
+	items, err = o.ReadAll(rc, queue.Outbox{"8291264a-4581-4d12-96e5-e9fcfa6e68d9", "65vbbDAQCdPdEWlEhDGy4utO"})
+	assert.NoError(t, err)
+	assert.Len(t, items, 0)
+}
+
+func TestOutboxesEvents(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetValkey()
+
+	ch := &models.Channel{UUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9"}
+	o := &queue.Outboxes{KeyBase: "chattest", InstanceID: "foo1", Window: 3}
+	outbox := queue.Outbox{ChannelUUID: ch.UUID, ChatID: "65vbbDAQCdPdEWlEhDGy4utO"}
+	bob := &models.User{ID: 1, Email: "bob@nyaruka.com", Name: "Bob McFlows"}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	// events are queued alongside messages
+	err := o.AddEvent(rc, ch, outbox.ChatID, models.NewChatEvent("0191a4e4-b5f4-7e2a-9e5a-5d0e4c07b1a3", models.ChatEventTypeTicketOpened, nil, time.Date(2024, 1, 30, 12, 55, 0, 0, time.UTC)))
+	assert.NoError(t, err)
+	err = o.AddMessage(rc, ch, outbox.ChatID, models.NewMsgOut(101, "hi", nil, models.MsgOriginChat, bob, time.Date(2024, 1, 30, 12, 56, 0, 0, time.UTC)))
+	assert.NoError(t, err)
+	err = o.AddEvent(rc, ch, outbox.ChatID, models.NewChatEvent("0191a4e4-c0a1-7d55-8a9b-0c2d1e3f4a5b", models.ChatEventTypeTicketAssigned, bob, time.Date(2024, 1, 30, 12, 57, 0, 0, time.UTC)))
+	assert.NoError(t, err)
+
+	assertvk.LGetAll(t, rc, "chattest:outbox:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", []string{
+		`{"id":"e0191a4e4-b5f4-7e2a-9e5a-5d0e4c07b1a3","ts":1706619300000,"event":{"uuid":"0191a4e4-b5f4-7e2a-9e5a-5d0e4c07b1a3","type":"ticket_opened","time":"2024-01-30T12:55:00Z"}}`,
+		`{"id":"m101","ts":1706619360000,"msg":{"id":101,"text":"hi","origin":"chat","user":{"id":1,"email":"bob@nyaruka.com","name":"Bob McFlows"},"time":"2024-01-30T12:56:00Z"}}`,
+		`{"id":"e0191a4e4-c0a1-7d55-8a9b-0c2d1e3f4a5b","ts":1706619420000,"event":{"uuid":"0191a4e4-c0a1-7d55-8a9b-0c2d1e3f4a5b","type":"ticket_assigned","assignee":{"id":1,"email":"bob@nyaruka.com","name":"Bob McFlows"},"time":"2024-01-30T12:57:00Z"}}`,
+	})
+	assertvk.ZGetAll(t, rc, "chattest:outboxes", map[string]float64{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": 1706619300000})
+
+	require.NoError(t, o.SetReady(rc, ch, outbox.ChatID, true))
+
+	ready, err := o.ReadReady(rc)
+	assert.NoError(t, err)
+	if assert.Len(t, ready[outbox], 3) {
+		assert.Equal(t, models.ChatEventTypeTicketOpened, ready[outbox][0].Event.Type)
+		assert.Nil(t, ready[outbox][0].Msg)
+		assert.Equal(t, "hi", ready[outbox][1].Msg.Text)
+		assert.Nil(t, ready[outbox][1].Event)
+		assert.Equal(t, bob, ready[outbox][2].Event.Assignee)
+	}
+
+	// and acknowledged the same way
+	hasMore, err := o.RecordSent(rc, ch, outbox.ChatID, "e0191a4e4-b5f4-7e2a-9e5a-5d0e4c07b1a3")
+	assert.NoError(t, err)
+	assert.False(t, hasMore)
+	assertvk.ZGetAll(t, rc, "chattest:outboxes", map[string]float64{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": 1706619360000})
+}
+
+func TestOutboxesWindow(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetValkey()
+
+	ch := &models.Channel{UUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9"}
+	o := &queue.Outboxes{KeyBase: "chattest", InstanceID: "foo1", Window: 3}
+	outbox := queue.Outbox{ChannelUUID: ch.UUID, ChatID: "65vbbDAQCdPdEWlEhDGy4utO"}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for i := range 5 {
+		msg := models.NewMsgOut(models.MsgID(101+i), "hi", nil, models.MsgOriginFlow, nil, time.Date(2024, 1, 30, 12, 55+i, 0, 0, time.UTC))
+		require.NoError(t, o.AddMessage(rc, ch, outbox.ChatID, msg))
+	}
+
+	require.NoError(t, o.SetReady(rc, ch, outbox.ChatID, true))
+
+	// reading should give us as many items as fit in the window, in order
+	ready, err := o.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.ItemID{"m101", "m102", "m103"}, itemIDs(ready[outbox]))
+	assertvk.HGetAll(t, rc, "chattest:sent", map[string]string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "3"})
+	assertvk.SMembers(t, rc, "chattest:ready:foo1", []string{})
+
+	// window is full so nothing more to read
+	ready, err = o.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Len(t, ready, 0)
+
+	// acknowledge the second item first
+	hasMore, err := o.RecordSent(rc, ch, outbox.ChatID, "m102")
+	assert.NoError(t, err)
+	assert.True(t, hasMore)
+	assertvk.LLen(t, rc, "chattest:outbox:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", 4)
+	assertvk.HGetAll(t, rc, "chattest:sent", map[string]string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "2"})
+	assertvk.ZGetAll(t, rc, "chattest:outboxes", map[string]float64{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": 1706619300000}) // oldest item unchanged
+
+	// that frees up space in the window for one more item
+	ready, err = o.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.ItemID{"m104"}, itemIDs(ready[outbox]))
+
+	// now acknowledge the first item
+	hasMore, err = o.RecordSent(rc, ch, outbox.ChatID, "m101")
+	assert.NoError(t, err)
+	assert.True(t, hasMore)
+	assertvk.ZGetAll(t, rc, "chattest:outboxes", map[string]float64{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": 1706619420000})
+
+	// client reconnects before acknowledging anything else, so unacknowledged items are sent again
+	require.NoError(t, o.SetReady(rc, ch, outbox.ChatID, false))
+	require.NoError(t, o.SetReady(rc, ch, outbox.ChatID, true))
+	assertvk.HGetAll(t, rc, "chattest:sent", map[string]string{})
+
+	ready, err = o.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.ItemID{"m103", "m104", "m105"}, itemIDs(ready[outbox]))
+
+	for _, id := range []queue.ItemID{"m105", "m103"} {
+		hasMore, err = o.RecordSent(rc, ch, outbox.ChatID, id)
+		assert.NoError(t, err)
+		assert.False(t, hasMore)
+	}
+
+	hasMore, err = o.RecordSent(rc, ch, outbox.ChatID, "m104")
+	assert.NoError(t, err)
+	assert.False(t, hasMore)
+
+	// outbox is now empty
+	assertvk.LLen(t, rc, "chattest:outbox:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", 0)
+	assertvk.ZGetAll(t, rc, "chattest:outboxes", map[string]float64{})
+	assertvk.HGetAll(t, rc, "chattest:sent", map[string]string{})
+}
+
+func TestOutboxesExpire(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetValkey()
+
+	ch := &models.Channel{UUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9"}
+	o := &queue.Outboxes{KeyBase: "chattest", InstanceID: "foo1", Window: 2, Timeout: time.Minute, MaxRetries: 1}
+	outbox := queue.Outbox{ChannelUUID: ch.UUID, ChatID: "65vbbDAQCdPdEWlEhDGy4utO"}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for i := range 3 {
+		msg := models.NewMsgOut(models.MsgID(101+i), "hi", nil, models.MsgOriginFlow, nil, time.Date(2024, 1, 30, 12, 55+i, 0, 0, time.UTC))
+		require.NoError(t, o.AddMessage(rc, ch, outbox.ChatID, msg))
+	}
+
+	require.NoError(t, o.SetReady(rc, ch, outbox.ChatID, true))
+
+	ready, err := o.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.ItemID{"m101", "m102"}, itemIDs(ready[outbox]))
+	assertvk.ZCard(t, rc, "chattest:inflight:foo1", 2)
+
+	// acknowledging an item means we stop waiting for it
+	_, err = o.RecordSent(rc, ch, outbox.ChatID, "m101")
+	assert.NoError(t, err)
+	assertvk.ZCard(t, rc, "chattest:inflight:foo1", 1)
+
+	// nothing has expired yet
+	retried, failed, err := o.ExpireSent(rc, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, retried)
+	assert.Len(t, failed, 0)
+
+	// but it will have in 2 minutes, and outbox should be ready again
+	retried, failed, err = o.ExpireSent(rc, time.Now().Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, retried)
+	assert.Len(t, failed, 0)
+	assertvk.SMembers(t, rc, "chattest:ready:foo1", []string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9"})
+	assertvk.HGetAll(t, rc, "chattest:retries", map[string]string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9/m102": "1"})
+
+	// so reading sends the unacknowledged item again, along with the next item
+	ready, err = o.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.ItemID{"m102", "m103"}, itemIDs(ready[outbox]))
+
+	// if neither is acknowledged, the item that's already been retried is failed and the other is retried
+	retried, failed, err = o.ExpireSent(rc, time.Now().Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, retried)
+	assert.Equal(t, map[queue.Outbox][]queue.ItemID{outbox: {"m102"}}, failed)
+	assertvk.LGetAll(t, rc, "chattest:outbox:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", []string{
+		`{"id":"m103","ts":1706619420000,"msg":{"id":103,"text":"hi","origin":"flow","time":"2024-01-30T12:57:00Z"}}`,
+	})
+	assertvk.ZGetAll(t, rc, "chattest:outboxes", map[string]float64{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": 1706619420000})
+	assertvk.HGetAll(t, rc, "chattest:retries", map[string]string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9/m103": "1"})
+
+	ready, err = o.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.ItemID{"m103"}, itemIDs(ready[outbox]))
+
+	// if client disconnects, this instance no longer retries its items
+	require.NoError(t, o.SetReady(rc, ch, outbox.ChatID, false))
+
+	retried, failed, err = o.ExpireSent(rc, time.Now().Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.False(t, retried)
+	assert.Len(t, failed, 0)
+	assertvk.ZCard(t, rc, "chattest:inflight:foo1", 0)
+
+	// purging the outbox forgets retry counts
+	items, err := o.ReadAll(rc, outbox)
+	assert.NoError(t, err)
+	assert.NoError(t, o.Purge(rc, outbox, items))
+	assertvk.HGetAll(t, rc, "chattest:retries", map[string]string{})
+
+	// as does acknowledging an item that's been retried
+	msg := models.NewMsgOut(models.MsgID(104), "hi", nil, models.MsgOriginFlow, nil, time.Date(2024, 1, 30, 12, 58, 0, 0, time.UTC))
+	require.NoError(t, o.AddMessage(rc, ch, outbox.ChatID, msg))
+	require.NoError(t, o.SetReady(rc, ch, outbox.ChatID, true))
+
+	ready, err = o.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.ItemID{"m104"}, itemIDs(ready[outbox]))
+
+	retried, _, err = o.ExpireSent(rc, time.Now().Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, retried)
+	assertvk.HGetAll(t, rc, "chattest:retries", map[string]string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9/m104": "1"})
+
+	ready, err = o.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.ItemID{"m104"}, itemIDs(ready[outbox]))
+
+	_, err = o.RecordSent(rc, ch, outbox.ChatID, "m104")
+	assert.NoError(t, err)
+	assertvk.HGetAll(t, rc, "chattest:retries", map[string]string{})
+	assertvk.ZCard(t, rc, "chattest:inflight:foo1", 0)
+}
+
+func itemIDs(items []*queue.Item) []queue.ItemID {
+	ids := make([]queue.ItemID, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
+	}
+	return ids
+}
+
+func TestOutboxesNotify(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetValkey()
+
+	ch := &models.Channel{UUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9"}
+	o1 := &queue.Outboxes{KeyBase: "chattest", InstanceID: "foo1"}
+	o2 := &queue.Outboxes{KeyBase: "chattest", InstanceID: "foo2"}
+
+	assert.Equal(t, "chattest:ready:foo1", o1.NotifyChannel())
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	var received []*pubsub.Message
+	var mutex sync.Mutex
+
+	listener := pubsub.NewListener(rt.RP, o1.NotifyChannel(), func(m *pubsub.Message) {
+		mutex.Lock()
+		received = append(received, m)
+		mutex.Unlock()
+	})
+	listener.Start()
+	defer listener.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// instance 1 is ready to send to one chat, instance 2 to another
+	assert.NoError(t, o1.SetReady(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", true))
+	assert.NoError(t, o2.SetReady(rc, ch, "3xdF7KhyEiabBiCd3Cst3X28", true))
+
+	assertvk.HGetAll(t, rc, "chattest:owners", map[string]string{
+		"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "foo1",
+		"3xdF7KhyEiabBiCd3Cst3X28@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "foo2",
+	})
+
+	// queue messages for both chats and a chat with no owner - only instance 1's chat should notify instance 1
+	assert.NoError(t, o1.AddMessage(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", models.NewMsgOut(101, "hi", nil, models.MsgOriginChat, nil, time.Now())))
+	assert.NoError(t, o1.AddMessage(rc, ch, "3xdF7KhyEiabBiCd3Cst3X28", models.NewMsgOut(102, "hi", nil, models.MsgOriginChat, nil, time.Now())))
+	assert.NoError(t, o1.AddMessage(rc, ch, "itlu4O6ZE4ZZc07Y5rHxcLoQ", models.NewMsgOut(103, "hi", nil, models.MsgOriginChat, nil, time.Now())))
+
+	// can also notify the instances with clients for a chat directly
+	owned, err := o2.Notify(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", &pubsub.Message{Type: pubsub.MessageTypeTyping, ChannelUUID: ch.UUID, ChatID: "65vbbDAQCdPdEWlEhDGy4utO"})
+	assert.NoError(t, err)
+	assert.True(t, owned)
+
+	owned, err = o2.Notify(rc, ch, "itlu4O6ZE4ZZc07Y5rHxcLoQ", &pubsub.Message{Type: pubsub.MessageTypeTyping, ChannelUUID: ch.UUID, ChatID: "itlu4O6ZE4ZZc07Y5rHxcLoQ"})
+	assert.NoError(t, err)
+	assert.False(t, owned)
+
+	time.Sleep(100 * time.Millisecond)
+
+	mutex.Lock()
+	assert.Equal(t, []*pubsub.Message{
+		{Type: pubsub.MessageTypeOutbox, ChannelUUID: ch.UUID, ChatID: "65vbbDAQCdPdEWlEhDGy4utO"},
+		{Type: pubsub.MessageTypeTyping, ChannelUUID: ch.UUID, ChatID: "65vbbDAQCdPdEWlEhDGy4utO"},
+	}, received)
+	mutex.Unlock()
+
+	// if chat moves to instance 2, instance 1 un-readying it shouldn't remove instance 2's ownership
+	assert.NoError(t, o2.SetReady(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", true))
+	assert.NoError(t, o1.SetReady(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", false))
+
+	assertvk.HGetAll(t, rc, "chattest:owners", map[string]string{
+		"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "foo2",
+		"3xdF7KhyEiabBiCd3Cst3X28@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "foo2",
+	})
+
+	assert.NoError(t, o2.SetReady(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", false))
+
+	assertvk.HGetAll(t, rc, "chattest:owners", map[string]string{
+		"3xdF7KhyEiabBiCd3Cst3X28@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "foo2",
+	})
+}
+
+func TestOutboxesMultipleInstances(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetValkey()
+
+	ch := &models.Channel{UUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9"}
+	o1 := &queue.Outboxes{KeyBase: "chattest", InstanceID: "foo1", Window: 2, Timeout: time.Minute}
+	o2 := &queue.Outboxes{KeyBase: "chattest", InstanceID: "foo2", Window: 2, Timeout: time.Minute}
+	outbox := queue.Outbox{ChannelUUID: ch.UUID, ChatID: "65vbbDAQCdPdEWlEhDGy4utO"}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	var received1, received2 []*pubsub.Message
+	var mutex sync.Mutex
+
+	listener1 := pubsub.NewListener(rt.RP, o1.NotifyChannel(), func(m *pubsub.Message) {
+		mutex.Lock()
+		received1 = append(received1, m)
+		mutex.Unlock()
+	})
+	listener1.Start()
+	defer listener1.Stop()
+
+	listener2 := pubsub.NewListener(rt.RP, o2.NotifyChannel(), func(m *pubsub.Message) {
+		mutex.Lock()
+		received2 = append(received2, m)
+		mutex.Unlock()
+	})
+	listener2.Start()
+	defer listener2.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	for i := range 3 {
+		msg := models.NewMsgOut(models.MsgID(101+i), "hi", nil, models.MsgOriginFlow, nil, time.Date(2024, 1, 30, 12, 55+i, 0, 0, time.UTC))
+		require.NoError(t, o1.AddMessage(rc, ch, outbox.ChatID, msg))
+	}
+
+	// a client connects to instance 1 which sends it the first items
+	require.NoError(t, o1.SetReady(rc, ch, outbox.ChatID, true))
+
+	ready, err := o1.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.ItemID{"m101", "m102"}, itemIDs(ready[outbox]))
+
+	// a second client connects to instance 1, which has already sent it those items so doesn't send them again
+	require.NoError(t, o1.SetReady(rc, ch, outbox.ChatID, true))
+	assertvk.HGetAll(t, rc, "chattest:sent", map[string]string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "2"})
+
+	ready, err = o1.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Len(t, ready, 0)
+
+	// a third client connects to instance 2, which takes over the outbox and waiting for the items already sent
+	require.NoError(t, o2.SetReady(rc, ch, outbox.ChatID, true))
+	assertvk.SMembers(t, rc, "chattest:instances:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", []string{"foo1", "foo2"})
+	assertvk.HGetAll(t, rc, "chattest:owners", map[string]string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "foo2"})
+	assertvk.HGetAll(t, rc, "chattest:sent", map[string]string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "2"})
+	assertvk.ZCard(t, rc, "chattest:inflight:foo1", 0)
+	assertvk.ZCard(t, rc, "chattest:inflight:foo2", 2)
+
+	// but it doesn't send them again either
+	ready, err = o2.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Len(t, ready, 0)
+
+	// a client on instance 1 acknowledges an item, which frees up the window on instance 2 and notifies it
+	hasMore, err := o1.RecordSent(rc, ch, outbox.ChatID, "m101")
+	assert.NoError(t, err)
+	assert.False(t, hasMore)
+	assertvk.ZCard(t, rc, "chattest:inflight:foo2", 1)
+	assertvk.SMembers(t, rc, "chattest:ready:foo1", []string{})
+	assertvk.SMembers(t, rc, "chattest:ready:foo2", []string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9"})
+
+	ready, err = o2.ReadReady(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.ItemID{"m103"}, itemIDs(ready[outbox]))
+
+	// instance 2 forwards what it sends to the clients on instance 1
+	item := &pubsub.Message{Type: pubsub.MessageTypeOutboxItem, ChannelUUID: ch.UUID, ChatID: outbox.ChatID, Msg: ready[outbox][0].Msg}
+	assert.NoError(t, o2.Forward(rc, outbox, item))
+
+	// when instance 2's client disconnects, the outbox is handed back to instance 1, which is notified
+	require.NoError(t, o2.SetReady(rc, ch, outbox.ChatID, false))
+	assertvk.SMembers(t, rc, "chattest:instances:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", []string{"foo1"})
+	assertvk.HGetAll(t, rc, "chattest:owners", map[string]string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "foo1"})
+	assertvk.HGetAll(t, rc, "chattest:sent", map[string]string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": "2"})
+	assertvk.ZCard(t, rc, "chattest:inflight:foo1", 2)
+	assertvk.ZCard(t, rc, "chattest:inflight:foo2", 0)
+	assertvk.SMembers(t, rc, "chattest:ready:foo1", []string{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9"})
+	assertvk.SMembers(t, rc, "chattest:ready:foo2", []string{})
+
+	// and acknowledging the remaining items on instance 1 works as normal
+	for _, id := range []queue.ItemID{"m102", "m103"} {
+		hasMore, err = o1.RecordSent(rc, ch, outbox.ChatID, id)
+		assert.NoError(t, err)
+		assert.False(t, hasMore)
+	}
+	assertvk.ZCard(t, rc, "chattest:inflight:foo1", 0)
+
+	// once instance 1's clients have also disconnected, nobody owns the outbox
+	require.NoError(t, o1.SetReady(rc, ch, outbox.ChatID, false))
+	assertvk.SMembers(t, rc, "chattest:instances:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", []string{})
+	assertvk.HGetAll(t, rc, "chattest:owners", map[string]string{})
+
+	time.Sleep(100 * time.Millisecond)
+
+	mutex.Lock()
+	assert.Equal(t, []*pubsub.Message{
+		{Type: pubsub.MessageTypeOutboxItem, ChannelUUID: ch.UUID, ChatID: outbox.ChatID, Msg: ready[outbox][0].Msg},
+		{Type: pubsub.MessageTypeOutbox, ChannelUUID: ch.UUID, ChatID: outbox.ChatID},
+	}, received1)
+	assert.Equal(t, []*pubsub.Message{
+		{Type: pubsub.MessageTypeOutbox, ChannelUUID: ch.UUID, ChatID: outbox.ChatID},
+	}, received2)
+	mutex.Unlock()
+}
+
+// compares delivery latency and Valkey load of polling for ready outboxes vs waiting for notifications
+func BenchmarkDelivery(b *testing.B) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetValkey()
+
+	ch := &models.Channel{UUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9"}
+
+	// create some other outboxes which aren't ready, that polling will still have to consider
+	rc := rt.RP.Get()
+	defer rc.Close()
+	other := &queue.Outboxes{KeyBase: "chattest", InstanceID: "other"}
+	for i := range 1000 {
+		require.NoError(b, other.AddMessage(rc, ch, models.ChatID(fmt.Sprintf("chat%d", i)), models.NewMsgOut(models.MsgID(i+1), "hi", nil, models.MsgOriginFlow, nil, time.Now())))
+	}
+
+	deliver := func(b *testing.B, wait func(o *queue.Outboxes, wake chan bool)) {
+		o := &queue.Outboxes{KeyBase: "chattest", InstanceID: "foo1"}
+		wake := make(chan bool, 1)
+
+		listener := pubsub.NewListener(rt.RP, o.NotifyChannel(), func(m *pubsub.Message) {
+			select {
+			case wake <- true:
+			default:
+			}
+		})
+		listener.Start()
+		defer listener.Stop()
+
+		rc := rt.RP.Get()
+		defer rc.Close()
+
+		require.NoError(b, o.SetReady(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", true))
+		time.Sleep(100 * time.Millisecond)
+
+		ops := commandsProcessed(b, rc)
+		b.ResetTimer()
+
+		for i := range b.N {
+			require.NoError(b, o.AddMessage(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", models.NewMsgOut(models.MsgID(10000+i), "hi", nil, models.MsgOriginFlow, nil, time.Now())))
+
+			for {
+				wait(o, wake)
+
+				ready, err := o.ReadReady(rc)
+				require.NoError(b, err)
+				if items := ready[queue.Outbox{ChannelUUID: ch.UUID, ChatID: "65vbbDAQCdPdEWlEhDGy4utO"}]; len(items) > 0 {
+					_, err := o.RecordSent(rc, ch, "65vbbDAQCdPdEWlEhDGy4utO", items[0].ID)
+					require.NoError(b, err)
+					break
+				}
+			}
+		}
+
+		b.StopTimer()
+		b.ReportMetric(float64(commandsProcessed(b, rc)-ops)/b.Elapsed().Seconds(), "vkops/s")
+	}
+
+	b.Run("polling", func(b *testing.B) {
+		deliver(b, func(o *queue.Outboxes, wake chan bool) { time.Sleep(100 * time.Millisecond) })
+	})
+	b.Run("notified", func(b *testing.B) {
+		deliver(b, func(o *queue.Outboxes, wake chan bool) {
+			select {
+			case <-wake:
+			case <-time.After(5 * time.Second):
+			}
+		})
+	})
+}
+
+// gets the total number of commands processed by the Valkey server
+func commandsProcessed(b *testing.B, rc redis.Conn) int {
+	info, err := redis.String(rc.Do("INFO", "stats"))
+	require.NoError(b, err)
+
+	for _, line := range strings.Split(info, "\r\n") {
+		if v, ok := strings.CutPrefix(line, "total_commands_processed:"); ok {
+			n, err := strconv.Atoi(v)
+			require.NoError(b, err)
+			return n
+		}
+	}
+	return 0
 }
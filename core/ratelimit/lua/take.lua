@@ -0,0 +1,36 @@
+local now = tonumber(ARGV[1])
+
+-- refill each bucket based on time since it was last used, and check it has a token to take
+local buckets = {}
+local allowed = true
+
+for i, key in ipairs(KEYS) do
+    local capacity, period = tonumber(ARGV[i * 2]), tonumber(ARGV[i * 2 + 1])
+    local state = redis.call("HMGET", key, "tokens", "ts")
+    local tokens = tonumber(state[1]) or capacity
+    local ts = tonumber(state[2]) or now
+
+    tokens = math.min(capacity, tokens + math.max(0, now - ts) * capacity / period)
+
+    if tokens < 1 then
+        allowed = false
+    end
+
+    buckets[i] = {tokens, period}
+end
+
+-- only take tokens if every bucket has one
+for i, key in ipairs(KEYS) do
+    local tokens, period = buckets[i][1], buckets[i][2]
+    if allowed then
+        tokens = tokens - 1
+    end
+
+    redis.call("HSET", key, "tokens", tostring(tokens), "ts", tostring(now))
+    redis.call("PEXPIRE", key, period)
+end
+
+if allowed then
+    return 1
+end
+return 0
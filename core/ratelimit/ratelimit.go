@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	_ "embed"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+//go:embed lua/take.lua
+var take string
+var takeScript = redis.NewScript(-1, take)
+
+// Limit allows Count actions per Period, refilling gradually so that bursts of up to Count are allowed
+type Limit struct {
+	Count  int
+	Period time.Duration
+}
+
+// ParseLimit parses a limit like 10/1m
+func ParseLimit(s string) (*Limit, error) {
+	c, p, ok := strings.Cut(s, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid limit '%s'", s)
+	}
+
+	count, err := strconv.Atoi(c)
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("invalid limit count '%s'", c)
+	}
+
+	period, err := time.ParseDuration(p)
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("invalid limit period '%s'", p)
+	}
+
+	return &Limit{Count: count, Period: period}, nil
+}
+
+func (l *Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Count, l.Period)
+}
+
+// Bucket is a token bucket stored in Valkey with the given key
+type Bucket struct {
+	Key   string
+	Limit *Limit
+}
+
+// Take takes a token from each of the given buckets if they all have one, and returns whether they did
+func Take(rc redis.Conn, now time.Time, buckets ...*Bucket) (bool, error) {
+	if len(buckets) == 0 {
+		return true, nil
+	}
+
+	args := redis.Args{}.Add(len(buckets))
+	for _, b := range buckets {
+		args = args.Add(b.Key)
+	}
+	args = args.Add(now.UnixMilli())
+	for _, b := range buckets {
+		args = args.Add(b.Limit.Count, b.Limit.Period.Milliseconds())
+	}
+
+	return redis.Bool(takeScript.Do(rc, args...))
+}
+
+// Local is a set of token buckets held in memory, for when buckets can't be stored in Valkey
+type Local struct {
+	buckets   map[string]*localBucket
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+type localBucket struct {
+	tokens float64
+	ts     time.Time
+	limit  *Limit
+}
+
+// NewLocal creates a new empty set of in-memory buckets
+func NewLocal() *Local {
+	return &Local{buckets: make(map[string]*localBucket)}
+}
+
+// Take takes a token from the bucket with the given key if it has one, and returns whether it did
+func (l *Local) Take(now time.Time, key string, limit *Limit) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// forget buckets which have refilled since they were last used, as they're the same as new buckets
+	if now.Sub(l.lastPrune) >= time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.ts) >= b.limit.Period {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &localBucket{tokens: float64(limit.Count), ts: now}
+		l.buckets[key] = b
+	}
+
+	// refill based on time since the bucket was last used, like buckets in Valkey
+	elapsed := max(0, now.Sub(b.ts))
+	b.tokens = min(float64(limit.Count), b.tokens+float64(elapsed)*float64(limit.Count)/float64(limit.Period))
+	b.ts = now
+	b.limit = limit
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
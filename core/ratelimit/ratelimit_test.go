@@ -0,0 +1,90 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/chip/core/ratelimit"
+	"github.com/nyaruka/chip/testsuite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimit(t *testing.T) {
+	l, err := ratelimit.ParseLimit("10/1m")
+	assert.NoError(t, err)
+	assert.Equal(t, &ratelimit.Limit{Count: 10, Period: time.Minute}, l)
+	assert.Equal(t, "10/1m0s", l.String())
+
+	_, err = ratelimit.ParseLimit("10")
+	assert.EqualError(t, err, "invalid limit '10'")
+	_, err = ratelimit.ParseLimit("x/1m")
+	assert.EqualError(t, err, "invalid limit count 'x'")
+	_, err = ratelimit.ParseLimit("0/1m")
+	assert.EqualError(t, err, "invalid limit count '0'")
+	_, err = ratelimit.ParseLimit("10/x")
+	assert.EqualError(t, err, "invalid limit period 'x'")
+}
+
+func TestTake(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetValkey()
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	socket := &ratelimit.Bucket{Key: "chattest:ratelimit:socket", Limit: &ratelimit.Limit{Count: 2, Period: time.Minute}}
+	channel := &ratelimit.Bucket{Key: "chattest:ratelimit:channel", Limit: &ratelimit.Limit{Count: 3, Period: time.Minute}}
+	t0 := time.Date(2024, 5, 2, 16, 5, 0, 0, time.UTC)
+
+	take := func(now time.Time, buckets ...*ratelimit.Bucket) bool {
+		ok, err := ratelimit.Take(rc, now, buckets...)
+		require.NoError(t, err)
+		return ok
+	}
+
+	assert.True(t, take(t0))
+	assert.True(t, take(t0, socket, channel))
+	assert.True(t, take(t0, socket, channel))
+
+	// socket bucket is now empty so can't take from either
+	assert.False(t, take(t0, socket, channel))
+
+	// but channel bucket still has one token
+	assert.True(t, take(t0, channel))
+	assert.False(t, take(t0, channel))
+
+	// after 30 seconds, socket bucket has refilled one token and channel bucket 1.5 tokens
+	assert.True(t, take(t0.Add(30*time.Second), socket, channel))
+	assert.False(t, take(t0.Add(30*time.Second), socket, channel))
+	assert.False(t, take(t0.Add(30*time.Second), socket))
+
+	// buckets never refill beyond their limit
+	assert.True(t, take(t0.Add(time.Hour), socket))
+	assert.True(t, take(t0.Add(time.Hour), socket))
+	assert.False(t, take(t0.Add(time.Hour), socket))
+}
+
+func TestLocal(t *testing.T) {
+	local := ratelimit.NewLocal()
+	limit := &ratelimit.Limit{Count: 2, Period: time.Minute}
+
+	t0 := time.Date(2024, 5, 2, 16, 5, 0, 0, time.UTC)
+
+	assert.True(t, local.Take(t0, "socket1", limit))
+	assert.True(t, local.Take(t0, "socket1", limit))
+	assert.False(t, local.Take(t0, "socket1", limit))
+
+	// other buckets are separate
+	assert.True(t, local.Take(t0, "socket2", limit))
+
+	// after 30 seconds, bucket has refilled one token
+	assert.True(t, local.Take(t0.Add(30*time.Second), "socket1", limit))
+	assert.False(t, local.Take(t0.Add(30*time.Second), "socket1", limit))
+
+	// buckets never refill beyond their limit
+	assert.True(t, local.Take(t0.Add(time.Hour), "socket1", limit))
+	assert.True(t, local.Take(t0.Add(time.Hour), "socket1", limit))
+	assert.False(t, local.Take(t0.Add(time.Hour), "socket1", limit))
+}
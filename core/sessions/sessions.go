@@ -0,0 +1,133 @@
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/gocommon/dates"
+)
+
+// ErrInvalidToken is returned when a token is incorrectly signed, has expired or has been revoked
+var ErrInvalidToken = errors.New("invalid session token")
+
+// max number of unexpired tokens kept for each chat, e.g. one per open tab or device
+const maxTokens = 20
+
+// placeholder member left in a revoked chat's set so that it doesn't look like a chat that's never had a session
+const revokedMember = "revoked"
+
+// Sessions issues and validates the tokens that clients must provide to resume chats. Tokens are signed with the
+// channel secret, and each chat keeps a set of issued tokens scored by expiry so that several clients, e.g. tabs, can
+// each hold a valid token for the same chat.
+type Sessions struct {
+	KeyBase string
+	TTL     time.Duration
+}
+
+// Issue creates a new token for the given chat which is valid alongside any other unexpired tokens for that chat, except
+// for the token it replaces, if any, which is retired so that a token can't be used again once a chat is resumed with it
+func (s *Sessions) Issue(rc redis.Conn, ch *models.Channel, chatID models.ChatID, replaces string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	now := dates.Now()
+	expires := now.Add(s.TTL).Unix()
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	payload := fmt.Sprintf("%d.%s", expires, nonce)
+	key := s.sessionKey(ch, chatID)
+
+	rc.Send("MULTI")
+	rc.Send("ZREMRANGEBYSCORE", key, "-inf", now.Unix())
+	if parts := strings.Split(replaces, "."); len(parts) == 3 {
+		rc.Send("ZREM", key, parts[1])
+	}
+	rc.Send("ZADD", key, expires, nonce)
+	rc.Send("ZREMRANGEBYRANK", key, 0, -(maxTokens + 1)) // drop oldest tokens beyond our limit
+	rc.Send("EXPIRE", key, int(s.TTL/time.Second))
+	if _, err := rc.Do("EXEC"); err != nil {
+		return "", err
+	}
+
+	return payload + "." + sign(ch, chatID, payload), nil
+}
+
+// Validate checks that the given token is correctly signed, hasn't expired and is one of the tokens issued for the chat
+func (s *Sessions) Validate(rc redis.Conn, ch *models.Channel, chatID models.ChatID, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	expiresOn, nonce, signature := parts[0], parts[1], parts[2]
+
+	if !hmac.Equal([]byte(signature), []byte(sign(ch, chatID, expiresOn+"."+nonce))) {
+		return ErrInvalidToken
+	}
+
+	expires, err := strconv.ParseInt(expiresOn, 10, 64)
+	if err != nil || dates.Now().Unix() >= expires {
+		return ErrInvalidToken
+	}
+
+	score, err := redis.Int64(rc.Do("ZSCORE", s.sessionKey(ch, chatID), nonce))
+	if err == redis.ErrNil {
+		return ErrInvalidToken
+	} else if err != nil {
+		return err
+	}
+
+	if dates.Now().Unix() >= score {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// Exists returns whether the given chat has any issued tokens, revoked or not
+func (s *Sessions) Exists(rc redis.Conn, ch *models.Channel, chatID models.ChatID) (bool, error) {
+	return redis.Bool(rc.Do("EXISTS", s.sessionKey(ch, chatID)))
+}
+
+// Revoked returns whether the tokens issued for the given chat have been revoked
+func (s *Sessions) Revoked(rc redis.Conn, ch *models.Channel, chatID models.ChatID) (bool, error) {
+	_, err := redis.Int64(rc.Do("ZSCORE", s.sessionKey(ch, chatID), revokedMember))
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Revoke invalidates all tokens issued for the given chat
+func (s *Sessions) Revoke(rc redis.Conn, ch *models.Channel, chatID models.ChatID) error {
+	key := s.sessionKey(ch, chatID)
+
+	rc.Send("MULTI")
+	rc.Send("DEL", key)
+	rc.Send("ZADD", key, 0, revokedMember)
+	rc.Send("EXPIRE", key, int(s.TTL/time.Second))
+	_, err := rc.Do("EXEC")
+	return err
+}
+
+func (s *Sessions) sessionKey(ch *models.Channel, chatID models.ChatID) string {
+	return fmt.Sprintf("%s:session:%s@%s", s.KeyBase, chatID, ch.UUID)
+}
+
+// signs the given payload for the given chat using the channel secret
+func sign(ch *models.Channel, chatID models.ChatID, payload string) string {
+	mac := hmac.New(sha256.New, []byte(ch.Secret()))
+	mac.Write([]byte(fmt.Sprintf("%s:%s:%s", ch.UUID, chatID, payload)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,100 @@
+package sessions_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/chip/core/sessions"
+	"github.com/nyaruka/chip/testsuite"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/vkutil/assertvk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessions(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetValkey()
+	defer dates.SetNowFunc(time.Now)
+
+	dates.SetNowFunc(dates.NewFixedNow(time.Date(2024, 5, 2, 16, 5, 4, 0, time.UTC)))
+
+	ch1 := &models.Channel{UUID: "8291264a-4581-4d12-96e5-e9fcfa6e68d9", Config: map[string]any{"secret": "sesame"}}
+	ch2 := &models.Channel{UUID: "3a9b0b9e-4b0d-4fa6-9e2c-d0d9eb2c7c3a", Config: map[string]any{"secret": "sesame"}}
+	s := &sessions.Sessions{KeyBase: "chattest", TTL: time.Hour}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	token1, err := s.Issue(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", "")
+	require.NoError(t, err)
+	assert.Regexp(t, `^1714669504\.[\w-]{22}\.[\w-]{43}$`, token1)
+	assertvk.Exists(t, rc, "chattest:session:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9")
+
+	assert.NoError(t, s.Validate(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", token1))
+
+	// token isn't valid for another chat or channel
+	assert.Equal(t, sessions.ErrInvalidToken, s.Validate(rc, ch1, "3xdF7KhyEiabBiCd3Cst3X28", token1))
+	assert.Equal(t, sessions.ErrInvalidToken, s.Validate(rc, ch2, "65vbbDAQCdPdEWlEhDGy4utO", token1))
+
+	// or if it's been tampered with
+	assert.Equal(t, sessions.ErrInvalidToken, s.Validate(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", "1814669504"+token1[10:]))
+	assert.Equal(t, sessions.ErrInvalidToken, s.Validate(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", "xyz"))
+
+	// issuing a new token doesn't invalidate the previous one so that several clients can start the same chat
+	token2, err := s.Issue(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", "")
+	require.NoError(t, err)
+	assert.NotEqual(t, token1, token2)
+	assert.NoError(t, s.Validate(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", token1))
+	assert.NoError(t, s.Validate(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", token2))
+	assertvk.ZCard(t, rc, "chattest:session:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", 2)
+
+	// but a token which is replaced, i.e. because the chat was resumed with it, is retired
+	token4, err := s.Issue(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", token1)
+	require.NoError(t, err)
+	assert.Equal(t, sessions.ErrInvalidToken, s.Validate(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", token1))
+	assert.NoError(t, s.Validate(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", token2))
+	assert.NoError(t, s.Validate(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", token4))
+	assertvk.ZCard(t, rc, "chattest:session:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", 2)
+
+	exists, err := s.Exists(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = s.Exists(rc, ch1, "3xdF7KhyEiabBiCd3Cst3X28")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// but only a limited number of tokens are kept per chat
+	for range 20 {
+		_, err := s.Issue(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", "")
+		require.NoError(t, err)
+	}
+	assertvk.ZCard(t, rc, "chattest:session:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", 20)
+
+	// tokens expire
+	dates.SetNowFunc(dates.NewFixedNow(time.Date(2024, 5, 2, 17, 5, 4, 0, time.UTC)))
+	assert.Equal(t, sessions.ErrInvalidToken, s.Validate(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", token2))
+
+	// and expired tokens are removed when new ones are issued
+	token3, err := s.Issue(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", "")
+	require.NoError(t, err)
+	assertvk.ZCard(t, rc, "chattest:session:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", 1)
+
+	// and can be revoked, which leaves a placeholder so the chat still looks like it's had a session
+	require.NoError(t, s.Revoke(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO"))
+	assert.Equal(t, sessions.ErrInvalidToken, s.Validate(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO", token3))
+	assertvk.ZGetAll(t, rc, "chattest:session:65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9", map[string]float64{"revoked": 0})
+
+	exists, err = s.Exists(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	revoked, err := s.Revoked(rc, ch1, "65vbbDAQCdPdEWlEhDGy4utO")
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+	revoked, err = s.Revoked(rc, ch1, "3xdF7KhyEiabBiCd3Cst3X28")
+	assert.NoError(t, err)
+	assert.False(t, revoked)
+}
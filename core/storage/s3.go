@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/nyaruka/gocommon/aws/s3x"
+)
+
+type s3Storage struct {
+	s3     *s3x.Service
+	bucket string
+}
+
+// NewS3 creates a new storage which writes files to the given S3 bucket
+func NewS3(s3 *s3x.Service, bucket string) Storage {
+	return &s3Storage{s3: s3, bucket: bucket}
+}
+
+func (s *s3Storage) Name() string { return "s3" }
+
+// Put writes the given file to S3, with a content disposition so that browsers download rather than render it
+func (s *s3Storage) Put(ctx context.Context, path, contentType string, body []byte) (string, error) {
+	_, err := s.s3.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String(s.bucket),
+		Body:               bytes.NewReader(body),
+		Key:                aws.String(path),
+		ContentType:        aws.String(contentType),
+		ContentDisposition: aws.String("attachment"),
+		ACL:                types.ObjectCannedACLPublicRead,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error writing to S3: %w", err)
+	}
+	return s.URL(path), nil
+}
+
+func (s *s3Storage) URL(path string) string {
+	return s.s3.ObjectURL(s.bucket, path)
+}
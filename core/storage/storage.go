@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Storage is the interface for somewhere we can store uploaded files and make them publicly accessible
+type Storage interface {
+	Name() string
+	Put(ctx context.Context, path, contentType string, body []byte) (string, error)
+	URL(path string) string
+}
+
+// local filesystem storage which is mostly useful for testing
+type fsStorage struct {
+	dir     string
+	baseURL string
+}
+
+// NewFS creates a new storage which writes files to the given directory, and which are served from the given base URL
+func NewFS(dir, baseURL string) Storage {
+	return &fsStorage{dir: dir, baseURL: baseURL}
+}
+
+func (s *fsStorage) Name() string { return "fs" }
+
+func (s *fsStorage) Put(ctx context.Context, path, contentType string, body []byte) (string, error) {
+	fullPath := filepath.Join(s.dir, filepath.FromSlash(path))
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return "", fmt.Errorf("error creating directory: %w", err)
+	}
+	if err := os.WriteFile(fullPath, body, 0644); err != nil {
+		return "", fmt.Errorf("error writing file: %w", err)
+	}
+
+	return s.URL(path), nil
+}
+
+func (s *fsStorage) URL(path string) string {
+	return s.baseURL + path
+}
@@ -0,0 +1,28 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nyaruka/chip/core/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFS(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := storage.NewFS(dir, "http://localhost/wc/")
+	assert.Equal(t, "fs", s.Name())
+	assert.Equal(t, "http://localhost/wc/attachments/1/foo.jpg", s.URL("attachments/1/foo.jpg"))
+
+	url, err := s.Put(ctx, "attachments/1/foo.jpg", "image/jpeg", []byte("jpegdata"))
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost/wc/attachments/1/foo.jpg", url)
+
+	body, err := os.ReadFile(filepath.Join(dir, "attachments", "1", "foo.jpg"))
+	assert.NoError(t, err)
+	assert.Equal(t, "jpegdata", string(body))
+}
@@ -19,14 +19,40 @@ type Config struct {
 	Valkey     string `validate:"url,startswith=valkey:"             help:"URL for your Valkey instance"`
 	StorageURL string `validate:"url"                                help:"URL base for public storage, e.g. avatars"`
 	SentryDSN  string `                                              help:"the DSN used for logging errors to Sentry"`
+	SMTPServer string `                                              help:"the SMTP configuration for sending emails, e.g. smtp://user%40password@server:port/?from=foo%40gmail.com"`
 
 	AWSAccessKeyID     string `help:"access key ID to use for AWS services"`
 	AWSSecretAccessKey string `help:"secret access key to use for AWS services"`
 	AWSRegion          string `help:"region to use for AWS services, e.g. us-east-1"`
 
+	S3Endpoint          string `help:"S3 service endpoint, e.g. https://s3.amazonaws.com"`
+	S3AttachmentsBucket string `help:"S3 bucket to write uploaded attachments to, if empty they are written to the local filesystem"`
+	S3Minio             bool   `help:"S3 is actually Minio or other compatible service"`
+	AttachmentsDir      string `help:"the local directory to write uploaded attachments to if not using S3"`
+	AttachmentMaxSize   int    `help:"the default maximum size in bytes of uploaded attachments"`
+	AttachmentTypes     string `help:"the default comma separated list of allowed content types of uploaded attachments"`
+	AllowedOrigins      string `help:"the default comma separated list of origins of sites which can embed the widget, defaults to * in development"`
+	UpdatableFields     string `help:"the default comma separated list of contact fields which the widget can set, including name and language"`
+
 	CloudwatchNamespace string `help:"the namespace to use for cloudwatch metrics"`
 	DeploymentID        string `help:"the deployment identifier to use for metrics"`
 
+	PollInterval   int `help:"interval in milliseconds at which to poll outboxes in case a notification was missed"`
+	SendWindow     int `help:"max number of messages per chat that can be sent to the client without being acknowledged"`
+	SendTimeout    int `help:"time in seconds to wait for a message to be acknowledged by the client before sending it again"`
+	SendRetries    int `help:"number of times an unacknowledged message is sent again before it's reported as failed"`
+	StaleOutboxAge int `help:"age in minutes after which undelivered messages are emailed to the contact or failed"`
+	SweepInterval  int `help:"interval in seconds at which to look for stale outboxes"`
+	SessionTTL     int `help:"time in hours after which chat session tokens expire"`
+	HistoryLimit   int `help:"max number of messages that clients can request in a page of history"`
+
+	SessionMigration bool `help:"whether chats which have never been issued a session token can be resumed by chat ID alone"`
+
+	RateLimitSocket  string `help:"the default limit of each of connects, chat starts and messages per socket, e.g. 30/1m"`
+	RateLimitIP      string `help:"the default limit of each of connects, chat starts and messages per IP address, e.g. 60/1m"`
+	RateLimitChannel string `help:"the default limit of each of connects, chat starts and messages per channel, e.g. 1000/1m"`
+	TrustedProxies   string `help:"comma separated list of IP addresses or CIDR ranges of proxies whose X-Real-IP and X-Forwarded-For headers are trusted"`
+
 	InstanceID string     `help:"the unique identifier of this instance, defaults to hostname"`
 	LogLevel   slog.Level `help:"the logging level to use"`
 	Version    string     `help:"the version of this install"`
@@ -49,9 +75,34 @@ func NewDefaultConfig() *Config {
 		AWSSecretAccessKey: "",
 		AWSRegion:          "us-east-1",
 
+		S3Endpoint:          "https://s3.amazonaws.com",
+		S3AttachmentsBucket: "",
+		S3Minio:             false,
+		AttachmentsDir:      "_storage",
+		AttachmentMaxSize:   10 * 1024 * 1024,
+		AttachmentTypes:     "image/*,audio/*,video/*,application/pdf",
+		AllowedOrigins:      "",
+		UpdatableFields:     "name,language",
+
 		CloudwatchNamespace: "Temba",
 		DeploymentID:        "dev",
 
+		PollInterval:   5000,
+		SendWindow:     10,
+		SendTimeout:    30,
+		SendRetries:    3,
+		StaleOutboxAge: 60 * 24,
+		SweepInterval:  60,
+		SessionTTL:     24 * 30,
+		HistoryLimit:   100,
+
+		SessionMigration: false,
+
+		RateLimitSocket:  "30/1m",
+		RateLimitIP:      "60/1m",
+		RateLimitChannel: "1000/1m",
+		TrustedProxies:   "",
+
 		InstanceID: hostname,
 		LogLevel:   slog.LevelInfo,
 		Version:    "Dev",
@@ -63,6 +114,11 @@ func LoadConfig() *Config {
 	loader := ezconf.NewLoader(config, "chip", "Chip - webchat server", []string{"config.toml"})
 	loader.MustLoad()
 
+	// any site can embed the widget in development, but other deployments have to say which sites can
+	if config.AllowedOrigins == "" && config.DeploymentID == "dev" {
+		config.AllowedOrigins = "*"
+	}
+
 	// ensure config is valid
 	if err := config.Validate(); err != nil {
 		log.Fatalf("invalid config: %s", err)
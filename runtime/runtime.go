@@ -7,11 +7,13 @@ import (
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/aws/cwatch"
 )
 
 type Runtime struct {
 	DB     *sql.DB
 	RP     *redis.Pool
+	CW     *cwatch.Service
 	Config *Config
 }
 
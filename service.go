@@ -10,35 +10,61 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/chip/core/courier"
+	"github.com/nyaruka/chip/core/mailer"
 	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/chip/core/pubsub"
 	"github.com/nyaruka/chip/core/queue"
+	"github.com/nyaruka/chip/core/sessions"
+	"github.com/nyaruka/chip/core/storage"
 	"github.com/nyaruka/chip/runtime"
 	"github.com/nyaruka/chip/web"
 	"github.com/nyaruka/chip/web/events"
+	"github.com/nyaruka/gocommon/uuids"
 )
 
 type Service struct {
-	rt       *runtime.Runtime
-	server   *web.Server
-	store    models.Store
-	outboxes *queue.Outboxes
-	courier  courier.Courier
-
-	senderStop chan bool
-	senderWait sync.WaitGroup
+	rt          *runtime.Runtime
+	server      *web.Server
+	store       models.Store
+	outboxes    *queue.Outboxes
+	sessions    *sessions.Sessions
+	courier     courier.Courier
+	mailer      mailer.Mailer
+	attachments storage.Storage
+	listener    *pubsub.Listener
+
+	senderWake  chan bool
+	senderStop  chan bool
+	senderWait  sync.WaitGroup
+	sweeperStop chan bool
+	sweeperWait sync.WaitGroup
 }
 
-func NewService(rt *runtime.Runtime, courier courier.Courier) *Service {
+func NewService(rt *runtime.Runtime, courier courier.Courier, mailer mailer.Mailer, attachments storage.Storage) *Service {
 	s := &Service{
-		rt:         rt,
-		store:      models.NewStore(rt),
-		outboxes:   &queue.Outboxes{KeyBase: "chat", InstanceID: rt.Config.InstanceID},
-		courier:    courier,
-		senderStop: make(chan bool),
+		rt:    rt,
+		store: models.NewStore(rt),
+		outboxes: &queue.Outboxes{
+			KeyBase:    "chat",
+			InstanceID: rt.Config.InstanceID,
+			Window:     rt.Config.SendWindow,
+			Timeout:    time.Duration(rt.Config.SendTimeout) * time.Second,
+			MaxRetries: rt.Config.SendRetries,
+		},
+		sessions:    &sessions.Sessions{KeyBase: "chat", TTL: time.Duration(rt.Config.SessionTTL) * time.Hour},
+		courier:     courier,
+		mailer:      mailer,
+		attachments: attachments,
+		senderWake:  make(chan bool, 1),
+		senderStop:  make(chan bool),
+		sweeperStop: make(chan bool),
 	}
 
 	s.server = web.NewServer(rt, s)
+	s.listener = pubsub.NewListener(rt.RP, s.outboxes.NotifyChannel(), s.onNotification)
 
 	return s
 }
@@ -48,9 +74,13 @@ func (s *Service) Start() error {
 
 	s.server.Start()
 	s.store.Start()
+	s.listener.Start()
 
 	go s.sender()
 
+	s.sweeperWait.Add(1)
+	go s.sweeper()
+
 	log.Info("started")
 	return nil
 }
@@ -62,6 +92,10 @@ func (s *Service) Stop() {
 	s.senderStop <- true
 	s.senderWait.Wait()
 
+	s.sweeperStop <- true
+	s.sweeperWait.Wait()
+
+	s.listener.Stop()
 	s.server.Stop()
 	s.store.Stop()
 
@@ -70,75 +104,311 @@ func (s *Service) Stop() {
 
 func (s *Service) Store() models.Store { return s.store }
 
-func (s *Service) StartChat(ctx context.Context, ch *models.Channel, chatID models.ChatID) (*models.Contact, bool, error) {
+// StartChat starts a new chat, or resumes an existing chat if the client provides its chat ID and a valid session token,
+// or an identity verified by the host site. Returns the contact, whether it's new, and a new session token for the client
+// which replaces the token the chat was resumed with.
+func (s *Service) StartChat(ctx context.Context, ch *models.Channel, chatID models.ChatID, token string, identity *models.Identity) (*models.Contact, bool, string, error) {
 	log := slog.With("comp", "service")
 	rc := s.rt.RP.Get()
 	defer rc.Close()
 
 	var contact *models.Contact
 	var isNew bool
+	var replaces string
 	var err error
 
+	// identified visitors always have the same chat ID
+	if identity != nil {
+		chatID = identity.ChatID(ch)
+	}
+
 	// if client provided a chat ID look for a matching contact
 	if chatID != "" {
 		contact, err = models.LoadContact(ctx, s.rt, ch.OrgID, chatID)
 		if err != nil && err != sql.ErrNoRows {
-			return nil, false, fmt.Errorf("error looking up contact: %w", err)
+			return nil, false, "", fmt.Errorf("error looking up contact: %w", err)
+		}
+
+		// resuming a chat requires one of its session tokens, unless the visitor is identified
+		if contact != nil && identity == nil {
+			if err := s.validateResume(rc, ch, chatID, token); err != nil {
+				return nil, false, "", fmt.Errorf("error validating session: %w", err)
+			}
+			replaces = token
+		}
+	}
+
+	// identified visitors resuming a chat may have changed their details on the host site
+	if contact != nil && identity != nil {
+		if err := s.updateIdentified(ctx, ch, contact, identity); err != nil {
+			return nil, false, "", err
 		}
 	}
 
 	// if not or if contact couldn't be found, generate a new random chat id, and have courier create a new contact
 	if contact == nil {
-		chatID = models.NewChatID()
+		if identity == nil {
+			chatID = models.NewChatID()
+		}
 		isNew = true
 
-		if err := s.courier.StartChat(ctx, ch, chatID); err != nil {
-			return nil, false, fmt.Errorf("error notifying courier of new chat: %w", err)
+		if err := s.courier.StartChat(ctx, ch, chatID, identity); err != nil {
+			return nil, false, "", fmt.Errorf("error notifying courier of new chat: %w", err)
 		}
 
 		// contact should now exist now...
 		contact, err = models.LoadContact(ctx, s.rt, ch.OrgID, chatID)
 		if err != nil {
-			return nil, false, fmt.Errorf("error looking up new contact: %w", err)
+			return nil, false, "", fmt.Errorf("error looking up new contact: %w", err)
 		}
+
+		if identity != nil && identity.Email != "" {
+			if err := contact.UpdateEmail(ctx, s.rt, identity.Email); err != nil {
+				return nil, false, "", fmt.Errorf("error updating contact email: %w", err)
+			}
+		}
+	}
+
+	// issue a new session token, which for a resumed chat retires the token it was resumed with, but leaves any others
+	// held by other clients valid
+	newToken, err := s.sessions.Issue(rc, ch, chatID, replaces)
+	if err != nil {
+		return nil, false, "", fmt.Errorf("error issuing session token: %w", err)
 	}
 
 	// mark chat as ready to send messages
 	if err := s.outboxes.SetReady(rc, ch, chatID, true); err != nil {
-		return nil, false, fmt.Errorf("error setting chat ready: %w", err)
+		return nil, false, "", fmt.Errorf("error setting chat ready: %w", err)
 	}
 
+	s.wakeSender()
+
 	log.Info("chat started", "chat_id", chatID)
-	return contact, isNew, nil
+	return contact, isNew, newToken, nil
 }
 
-func (s *Service) CreateMsgIn(ctx context.Context, ch *models.Channel, contact *models.Contact, text string) error {
-	if err := s.courier.CreateMsg(ctx, ch, contact, text); err != nil {
-		return fmt.Errorf("error notifying courier of new msg: %w", err)
+// updates an existing contact with the attributes of the verified identity they've resumed their chat with
+func (s *Service) updateIdentified(ctx context.Context, ch *models.Channel, contact *models.Contact, identity *models.Identity) error {
+	if update := identity.Update(); update != nil {
+		if err := s.courier.UpdateContact(ctx, ch, contact, update); err != nil {
+			return fmt.Errorf("error notifying courier of contact update: %w", err)
+		}
+	}
+
+	if identity.Email != "" && identity.Email != contact.Email {
+		if err := contact.UpdateEmail(ctx, s.rt, identity.Email); err != nil {
+			return fmt.Errorf("error updating contact email: %w", err)
+		}
 	}
 	return nil
 }
 
-func (s *Service) ConfirmDelivery(ctx context.Context, ch *models.Channel, contact *models.Contact, itemID queue.ItemID) error {
+// checks that a client can resume the given chat with the given token. While migrating, chats which predate session
+// tokens and so have never been issued one, can be resumed without a token.
+func (s *Service) validateResume(rc redis.Conn, ch *models.Channel, chatID models.ChatID, token string) error {
+	if token == "" && s.rt.Config.SessionMigration {
+		exists, err := s.sessions.Exists(rc, ch, chatID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+	}
+
+	return s.sessions.Validate(rc, ch, chatID, token)
+}
+
+// ValidateSession checks that the given token is a valid session token for the given chat
+func (s *Service) ValidateSession(ctx context.Context, ch *models.Channel, chatID models.ChatID, token string) error {
 	rc := s.rt.RP.Get()
 	defer rc.Close()
 
-	// if this is a message, tell courier it was delivered
-	if strings.HasPrefix(string(itemID), "m") {
-		msgID, err := strconv.Atoi(strings.TrimPrefix(string(itemID), "m"))
-		if err != nil {
-			return fmt.Errorf("error parsing msg id: %w", err)
+	return s.sessions.Validate(rc, ch, chatID, token)
+}
+
+// SessionRevoked returns whether the session tokens for the given chat have been revoked
+func (s *Service) SessionRevoked(ctx context.Context, ch *models.Channel, chatID models.ChatID) (bool, error) {
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	return s.sessions.Revoked(rc, ch, chatID)
+}
+
+// RevokeSession revokes all session tokens for the given contact's chat so that it can't be resumed
+func (s *Service) RevokeSession(ctx context.Context, ch *models.Channel, contact *models.Contact) error {
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	if err := s.sessions.Revoke(rc, ch, contact.ChatID); err != nil {
+		return fmt.Errorf("error revoking session: %w", err)
+	}
+	return nil
+}
+
+// StoreAttachment stores a file uploaded by the given contact and returns its public URL
+func (s *Service) StoreAttachment(ctx context.Context, ch *models.Channel, contact *models.Contact, contentType string, body []byte) (string, error) {
+	var ext string
+	if mt := mimetype.Lookup(contentType); mt != nil {
+		ext = mt.Extension()
+	}
+
+	url, err := s.attachments.Put(ctx, attachmentsPath(ch, contact)+string(uuids.NewV4())+ext, contentType, body)
+	if err != nil {
+		return "", fmt.Errorf("error storing attachment: %w", err)
+	}
+	return url, nil
+}
+
+func (s *Service) CreateMsgIn(ctx context.Context, ch *models.Channel, contact *models.Contact, text string, attachments []string, replyTo models.MsgID) (*models.MsgIn, error) {
+	// contacts can only send attachments that they've uploaded
+	prefix := s.attachments.URL(attachmentsPath(ch, contact))
+	for _, a := range attachments {
+		if !strings.HasPrefix(a, prefix) {
+			return nil, fmt.Errorf("%w: %s", models.ErrAttachmentNotUploaded, a)
 		}
+	}
 
-		if err := s.courier.ReportDelivered(ctx, ch, contact, models.MsgID(msgID)); err != nil {
-			return fmt.Errorf("error notifying courier of delivery: %w", err)
+	// contacts can only reply to messages that were sent to them
+	if replyTo != models.NilMsgID {
+		exists, err := models.OutgoingMsgExists(ctx, s.rt, ch, contact.ID, replyTo)
+		if err != nil {
+			return nil, fmt.Errorf("error checking reply_to msg: %w", err)
 		}
+		if !exists {
+			return nil, fmt.Errorf("%w: %d", models.ErrInvalidReplyTo, replyTo)
+		}
+	}
+
+	// let courier know if nobody is available to reply
+	flags := courier.MsgFlags{OutOfHours: !ch.Availability(time.Now()).Online}
+
+	msgIn, err := s.courier.CreateMsg(ctx, ch, contact, text, attachments, replyTo, flags)
+	if err != nil {
+		return nil, fmt.Errorf("error notifying courier of new msg: %w", err)
+	}
+
+	s.resolveMsgID(ctx, ch, msgIn)
+
+	return msgIn, nil
+}
+
+// courier only tells us the UUID of a message it creates, so look up its ID, which is left unknown if that fails since
+// the message has still been created
+func (s *Service) resolveMsgID(ctx context.Context, ch *models.Channel, msgIn *models.MsgIn) {
+	if msgIn.ID != models.NilMsgID || msgIn.UUID == "" {
+		return
+	}
+
+	id, err := models.LoadMsgID(ctx, s.rt, ch, msgIn.UUID)
+	if err != nil {
+		slog.Error("error looking up created msg", "comp", "service", "msg_uuid", msgIn.UUID, "error", err)
+	}
+	msgIn.ID = id
+}
+
+// LeaveMessage is used by a visitor who would rather leave a message than chat, e.g. because nobody is available. It
+// starts a new chat with their name and email, and creates the message flagged so that a ticket is opened for it.
+// Returns the new contact, their session token and the created message. If something fails after the chat is started,
+// the contact and token are still returned so that a retry can pass them back to carry on with the same chat.
+func (s *Service) LeaveMessage(ctx context.Context, ch *models.Channel, chatID models.ChatID, token, name, email, text string) (*models.Contact, string, *models.MsgIn, error) {
+	contact, _, token, err := s.StartChat(ctx, ch, chatID, token, nil)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	if err := contact.UpdateEmail(ctx, s.rt, email); err != nil {
+		return contact, token, nil, fmt.Errorf("error updating contact email: %w", err)
+	}
+
+	// the name is provided by the visitor directly so isn't subject to the channel's updatable fields
+	if err := s.courier.UpdateContact(ctx, ch, contact, &models.ContactUpdate{Name: name}); err != nil {
+		return contact, token, nil, fmt.Errorf("error notifying courier of contact update: %w", err)
 	}
 
-	if _, err := s.outboxes.RecordSent(rc, ch, contact.ChatID, itemID); err != nil {
+	flags := courier.MsgFlags{OutOfHours: !ch.Availability(time.Now()).Online, OpenTicket: true}
+
+	msgIn, err := s.courier.CreateMsg(ctx, ch, contact, text, nil, models.NilMsgID, flags)
+	if err != nil {
+		return contact, token, nil, fmt.Errorf("error notifying courier of new msg: %w", err)
+	}
+
+	s.resolveMsgID(ctx, ch, msgIn)
+
+	return contact, token, msgIn, nil
+}
+
+// path in attachments storage of the files uploaded by the given contact
+func attachmentsPath(ch *models.Channel, contact *models.Contact) string {
+	return fmt.Sprintf("attachments/%s/%d/", ch.UUID, contact.ID)
+}
+
+// ConfirmDelivery is called when a client acknowledges an outbox item. If the contact has multiple clients, only the
+// first acknowledgement is reported as delivery.
+func (s *Service) ConfirmDelivery(ctx context.Context, ch *models.Channel, contact *models.Contact, itemID queue.ItemID) error {
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	hasMore, err := s.outboxes.RecordSent(rc, ch, contact.ChatID, itemID)
+	if err == queue.ErrItemNotFound {
+		return nil // already acknowledged by another client
+	} else if err != nil {
 		return fmt.Errorf("error setting chat ready: %w", err)
 	}
 
+	if err := s.reportItemStatus(ctx, ch, contact, []queue.ItemID{itemID}, courier.MsgStatusDelivered); err != nil {
+		return err
+	}
+
+	// if there are more items in this outbox, send the next one now
+	if hasMore {
+		s.wakeSender()
+	}
+
+	return nil
+}
+
+// MarkRead reports to courier that the given message, or all messages up to the given time, have been read
+func (s *Service) MarkRead(ctx context.Context, ch *models.Channel, contact *models.Contact, msgID models.MsgID, upTo time.Time) error {
+	msgIDs, err := models.LoadUnreadMsgIDs(ctx, s.rt, ch, contact.ID, msgID, upTo)
+	if err != nil {
+		return fmt.Errorf("error loading unread messages: %w", err)
+	}
+
+	if len(msgIDs) > 0 {
+		if err := s.courier.ReportStatus(ctx, ch, contact, msgIDs, courier.MsgStatusRead); err != nil {
+			return fmt.Errorf("error notifying courier of read status: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ReportSendError is called when an outbox item couldn't be written to the client's socket. The item stays in the
+// outbox to be resent when the client reconnects.
+func (s *Service) ReportSendError(ctx context.Context, ch *models.Channel, contact *models.Contact, itemID queue.ItemID) error {
+	return s.reportItemStatus(ctx, ch, contact, []queue.ItemID{itemID}, courier.MsgStatusErrored)
+}
+
+// if the given outbox item is a message, reports the given status for it to courier
+func (s *Service) reportItemStatus(ctx context.Context, ch *models.Channel, contact *models.Contact, itemIDs []queue.ItemID, status courier.MsgStatus) error {
+	msgIDs := make([]models.MsgID, 0, len(itemIDs))
+	for _, itemID := range itemIDs {
+		if strings.HasPrefix(string(itemID), "m") {
+			msgID, err := strconv.Atoi(strings.TrimPrefix(string(itemID), "m"))
+			if err != nil {
+				return fmt.Errorf("error parsing msg id: %w", err)
+			}
+			msgIDs = append(msgIDs, models.MsgID(msgID))
+		}
+	}
+
+	// report all the messages in one request so that they succeed or fail together
+	if len(msgIDs) > 0 {
+		if err := s.courier.ReportStatus(ctx, ch, contact, msgIDs, status); err != nil {
+			return fmt.Errorf("error notifying courier of %s status: %w", status, err)
+		}
+	}
 	return nil
 }
 
@@ -167,18 +437,110 @@ func (s *Service) QueueMsgOut(ctx context.Context, ch *models.Channel, contact *
 	return nil
 }
 
+// QueueEvent queues a chat event, e.g. a ticket being closed, to be sent to the contact
+func (s *Service) QueueEvent(ctx context.Context, ch *models.Channel, contact *models.Contact, e *models.ChatEvent) error {
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	if err := s.outboxes.AddEvent(rc, ch, contact.ChatID, e); err != nil {
+		return fmt.Errorf("error queuing to outbox: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateContact asks courier to update the name, language or fields of the given contact, if the channel allows them
+// to be set by the widget
+func (s *Service) UpdateContact(ctx context.Context, ch *models.Channel, contact *models.Contact, update *models.ContactUpdate) error {
+	if err := update.Check(ch.UpdatableFields(s.rt.Config)); err != nil {
+		return err
+	}
+
+	if err := s.courier.UpdateContact(ctx, ch, contact, update); err != nil {
+		return fmt.Errorf("error notifying courier of contact update: %w", err)
+	}
+	return nil
+}
+
+// ReportTyping lets courier know that the contact is typing
+func (s *Service) ReportTyping(ctx context.Context, ch *models.Channel, contact *models.Contact) error {
+	if err := s.courier.ReportTyping(ctx, ch, contact); err != nil {
+		return fmt.Errorf("error notifying courier of typing: %w", err)
+	}
+	return nil
+}
+
+// NotifyTyping lets the contact's clients, on whichever instances have them, know that a user is typing
+func (s *Service) NotifyTyping(ctx context.Context, ch *models.Channel, contact *models.Contact, user *models.User) error {
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	if _, err := s.outboxes.Notify(rc, ch, contact.ChatID, &pubsub.Message{Type: pubsub.MessageTypeTyping, ChannelUUID: ch.UUID, ChatID: contact.ChatID, User: user}); err != nil {
+		return fmt.Errorf("error publishing typing notification: %w", err)
+	}
+	return nil
+}
+
+// NotifyMsgIn lets all the contact's clients, on whichever instances have them, know about a message they've sent so
+// that their transcripts match
+func (s *Service) NotifyMsgIn(ctx context.Context, ch *models.Channel, contact *models.Contact, msgIn *models.MsgIn) error {
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	if _, err := s.outboxes.Notify(rc, ch, contact.ChatID, &pubsub.Message{Type: pubsub.MessageTypeChatIn, ChannelUUID: ch.UUID, ChatID: contact.ChatID, MsgIn: msgIn}); err != nil {
+		return fmt.Errorf("error publishing msg notification: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) onNotification(m *pubsub.Message) {
+	switch m.Type {
+	case pubsub.MessageTypeOutbox:
+		s.wakeSender()
+	case pubsub.MessageTypeOutboxItem:
+		s.deliver(m.ChannelUUID, m.ChatID, m.Msg, m.Event)
+	case pubsub.MessageTypeTyping:
+		for _, client := range s.server.GetClients(m.ChannelUUID, m.ChatID) {
+			client.Send(events.NewTyping(m.User))
+		}
+	case pubsub.MessageTypeChatIn:
+		for _, client := range s.server.GetClients(m.ChannelUUID, m.ChatID) {
+			client.Send(events.NewChatMsgIn(m.MsgIn))
+		}
+	}
+}
+
+// wakes up the sender if it's waiting so that it reads ready outboxes now
+func (s *Service) wakeSender() {
+	select {
+	case s.senderWake <- true:
+	default: // already has a pending wake
+	}
+}
+
 func (s *Service) sender() {
 	defer s.senderWait.Done()
 	s.senderWait.Add(1)
 
+	var lastExpire time.Time
+
 	for {
 		// TODO panic recovery
+
+		// check for unacknowledged items at the poll interval, even if we're being woken more often
+		if time.Since(lastExpire) >= time.Duration(s.rt.Config.PollInterval)*time.Millisecond {
+			s.expire()
+			lastExpire = time.Now()
+		}
+
 		s.send()
 
+		// wait until we're notified of new outbox items, or poll anyway in case we missed a notification
 		select {
 		case <-s.senderStop:
 			return
-		case <-time.After(100 * time.Millisecond):
+		case <-s.senderWake:
+		case <-time.After(time.Duration(s.rt.Config.PollInterval) * time.Millisecond):
 		}
 	}
 }
@@ -195,12 +557,193 @@ func (s *Service) send() {
 		return
 	}
 
-	for outbox, item := range ready {
-		client := s.server.GetClient(outbox.ChatID)
-		if client != nil {
-			client.Send(events.NewChatMsgOut(item.Msg))
+	for outbox, items := range ready {
+		for _, item := range items {
+			s.deliver(outbox.ChannelUUID, outbox.ChatID, item.Msg, item.Event)
+
+			// clients for this chat on other instances get the item from us too
+			m := &pubsub.Message{Type: pubsub.MessageTypeOutboxItem, ChannelUUID: outbox.ChannelUUID, ChatID: outbox.ChatID, Msg: item.Msg, Event: item.Event}
+			if err := s.outboxes.Forward(rc, outbox, m); err != nil {
+				log.Error("error forwarding outbox item", "outbox", outbox, "item_id", item.ID, "error", err)
+			}
 		}
 	}
+}
+
+// sends an outbox item to this instance's clients for the given chat
+func (s *Service) deliver(channelUUID models.ChannelUUID, chatID models.ChatID, msg *models.MsgOut, event *models.ChatEvent) {
+	for _, client := range s.server.GetClients(channelUUID, chatID) {
+		if msg != nil {
+			client.Send(events.NewChatMsgOut(msg))
+		} else if event != nil {
+			e, err := events.NewTicketEvent(event)
+			if err != nil {
+				slog.Error("error converting chat event", "comp", "service", "channel", channelUUID, "chat_id", chatID, "error", err)
+				return
+			}
+			client.Send(e)
+		}
+	}
+}
+
+// finds sent items which haven't been acknowledged in time so that they're sent again, or if they've already been sent
+// the max number of times, reports them to courier as failed
+func (s *Service) expire() {
+	log := slog.With("comp", "service")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	_, failed, err := s.outboxes.ExpireSent(rc, time.Now())
+	if err != nil {
+		log.Error("error expiring sent items", "error", err)
+		return
+	}
+
+	for outbox, itemIDs := range failed {
+		if err := s.failItems(ctx, outbox, itemIDs); err != nil {
+			log.Error("error failing unacknowledged items", "outbox", outbox, "error", err)
+		}
+	}
+}
+
+func (s *Service) failItems(ctx context.Context, outbox queue.Outbox, itemIDs []queue.ItemID) error {
+	ch, err := s.store.GetChannel(ctx, outbox.ChannelUUID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error loading channel: %w", err)
+	}
 
-	// TODO email or fail stale messages
+	contact, err := models.LoadContact(ctx, s.rt, ch.OrgID, outbox.ChatID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error loading contact: %w", err)
+	}
+
+	return s.reportItemStatus(ctx, ch, contact, itemIDs, courier.MsgStatusFailed)
+}
+
+func (s *Service) sweeper() {
+	defer s.sweeperWait.Done()
+
+	for {
+		select {
+		case <-s.sweeperStop:
+			return
+		case <-time.After(time.Duration(s.rt.Config.SweepInterval) * time.Second):
+			s.sweep()
+		}
+	}
+}
+
+// finds outboxes whose oldest item is older than the configured age and either emails their messages to the contact
+// or reports them to courier as failed
+func (s *Service) sweep() {
+	log := slog.With("comp", "service")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	stale, err := s.outboxes.ReadStale(rc, time.Now().Add(-time.Duration(s.rt.Config.StaleOutboxAge)*time.Minute))
+	if err != nil {
+		log.Error("error reading stale outboxes", "error", err)
+		return
+	}
+
+	for _, outbox := range stale {
+		if err := s.sweepOutbox(ctx, rc, outbox); err != nil {
+			log.Error("error sweeping stale outbox", "outbox", outbox, "error", err)
+		}
+	}
+}
+
+// emails or fails the items in the given stale outbox, only removing them once that's been done, so that if it fails
+// they'll be tried again on the next sweep
+func (s *Service) sweepOutbox(ctx context.Context, rc redis.Conn, outbox queue.Outbox) error {
+	log := slog.With("comp", "service", "chat_id", outbox.ChatID)
+
+	ch, err := s.store.GetChannel(ctx, outbox.ChannelUUID)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error loading channel: %w", err)
+	}
+
+	items, err := s.outboxes.ReadAll(rc, outbox)
+	if err != nil {
+		return fmt.Errorf("error reading outbox: %w", err)
+	}
+
+	// channel no longer exists so nothing to do with these messages
+	if ch == nil {
+		return s.purgeOutbox(rc, outbox, items)
+	}
+
+	contact, err := models.LoadContact(ctx, s.rt, ch.OrgID, outbox.ChatID)
+	if err == sql.ErrNoRows {
+		return s.purgeOutbox(rc, outbox, items)
+	} else if err != nil {
+		return fmt.Errorf("error loading contact: %w", err)
+	}
+
+	msgs := make([]*models.MsgOut, 0, len(items))
+	for _, item := range items {
+		if item.Msg != nil {
+			msgs = append(msgs, item.Msg)
+		}
+	}
+	if len(msgs) == 0 {
+		return s.purgeOutbox(rc, outbox, items)
+	}
+
+	if contact.Email != "" {
+		err := s.mailer.Send(ctx, contact.Email, "You have unread messages", transcript(msgs))
+		if err == nil {
+			log.Info("emailed stale messages", "count", len(msgs))
+			return s.purgeOutbox(rc, outbox, items)
+		}
+
+		log.Error("error emailing stale messages, will fail instead", "error", err)
+	}
+
+	itemIDs := make([]queue.ItemID, len(items))
+	for i, item := range items {
+		itemIDs[i] = item.ID
+	}
+
+	if err := s.reportItemStatus(ctx, ch, contact, itemIDs, courier.MsgStatusFailed); err != nil {
+		return err
+	}
+
+	return s.purgeOutbox(rc, outbox, items)
+}
+
+func (s *Service) purgeOutbox(rc redis.Conn, outbox queue.Outbox, items []*queue.Item) error {
+	if err := s.outboxes.Purge(rc, outbox, items); err != nil {
+		return fmt.Errorf("error purging outbox: %w", err)
+	}
+	return nil
+}
+
+// formats the given messages as a plain text transcript for emailing
+func transcript(msgs []*models.MsgOut) string {
+	var b strings.Builder
+	for _, m := range msgs {
+		sender := "Support"
+		if m.User != nil && m.User.Name != "" {
+			sender = m.User.Name
+		}
+
+		fmt.Fprintf(&b, "[%s] %s: %s\n", m.Time.UTC().Format("2006-01-02 15:04"), sender, m.Text)
+		for _, a := range m.Attachments {
+			fmt.Fprintf(&b, "  %s\n", a)
+		}
+	}
+	return b.String()
 }
@@ -0,0 +1,329 @@
+package chip
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/chip/core/sessions"
+	"github.com/nyaruka/chip/testsuite"
+	"github.com/nyaruka/vkutil/assertvk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartChat(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer func() { testsuite.ResetValkey(); testsuite.ResetDB() }()
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame"})
+
+	ch, err := models.LoadChannel(ctx, rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9")
+	require.NoError(t, err)
+
+	mockCourier := testsuite.NewMockCourier(rt)
+	svc := NewService(rt, mockCourier, testsuite.NewMockMailer(), testsuite.Attachments(rt))
+
+	// start a new chat
+	contact, isNew, token1, err := svc.StartChat(ctx, ch, "", "", nil)
+	assert.NoError(t, err)
+	assert.True(t, isNew)
+	assert.NotEmpty(t, token1)
+	assert.NoError(t, svc.ValidateSession(ctx, ch, contact.ChatID, token1))
+
+	// resuming it requires a valid token
+	_, _, _, err = svc.StartChat(ctx, ch, contact.ChatID, "", nil)
+	assert.ErrorIs(t, err, sessions.ErrInvalidToken)
+
+	_, isNew, token2, err := svc.StartChat(ctx, ch, contact.ChatID, token1, nil)
+	assert.NoError(t, err)
+	assert.False(t, isNew)
+	assert.NotEqual(t, token1, token2)
+
+	// and resuming retires the token it was resumed with so that it can't be used again
+	assert.ErrorIs(t, svc.ValidateSession(ctx, ch, contact.ChatID, token1), sessions.ErrInvalidToken)
+	_, _, _, err = svc.StartChat(ctx, ch, contact.ChatID, token1, nil)
+	assert.ErrorIs(t, err, sessions.ErrInvalidToken)
+
+	// the new token can be used to resume the chat again, which in turn retires it
+	_, _, token4, err := svc.StartChat(ctx, ch, contact.ChatID, token2, nil)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, svc.ValidateSession(ctx, ch, contact.ChatID, token2), sessions.ErrInvalidToken)
+	assert.NoError(t, svc.ValidateSession(ctx, ch, contact.ChatID, token4))
+
+	revoked, err := svc.SessionRevoked(ctx, ch, contact.ChatID)
+	assert.NoError(t, err)
+	assert.False(t, revoked)
+
+	// revoking the session invalidates all tokens
+	assert.NoError(t, svc.RevokeSession(ctx, ch, contact))
+
+	_, _, _, err = svc.StartChat(ctx, ch, contact.ChatID, token4, nil)
+	assert.ErrorIs(t, err, sessions.ErrInvalidToken)
+
+	revoked, err = svc.SessionRevoked(ctx, ch, contact.ChatID)
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+
+	// chats which have never had a token can be resumed without one while migrating, but revoked chats can't
+	rt.Config.SessionMigration = true
+	defer func() { rt.Config.SessionMigration = false }()
+
+	_, _, _, err = svc.StartChat(ctx, ch, contact.ChatID, "", nil)
+	assert.ErrorIs(t, err, sessions.ErrInvalidToken)
+
+	vc := rt.RP.Get()
+	_, err = vc.Do("DEL", fmt.Sprintf("chat:session:%s@%s", contact.ChatID, ch.UUID))
+	vc.Close()
+	require.NoError(t, err)
+
+	_, isNew, token3, err := svc.StartChat(ctx, ch, contact.ChatID, "", nil)
+	assert.NoError(t, err)
+	assert.False(t, isNew)
+	assert.NoError(t, svc.ValidateSession(ctx, ch, contact.ChatID, token3))
+
+	// and once they have a token they need it
+	_, _, _, err = svc.StartChat(ctx, ch, contact.ChatID, "", nil)
+	assert.ErrorIs(t, err, sessions.ErrInvalidToken)
+
+	// identified visitor starts a chat and their attributes are passed to courier
+	identity := &models.Identity{ExternalID: "12345", Name: "Ann", Email: "ann@nyaruka.com"}
+
+	ann, isNew, _, err := svc.StartChat(ctx, ch, "", "", identity)
+	assert.NoError(t, err)
+	assert.True(t, isNew)
+	assert.Equal(t, identity.ChatID(ch), ann.ChatID)
+	assert.Equal(t, "ann@nyaruka.com", ann.Email)
+	assert.Equal(t, fmt.Sprintf("StartChat(8291264a-4581-4d12-96e5-e9fcfa6e68d9, %s, 12345)", ann.ChatID), mockCourier.Calls[1])
+
+	// and can resume it from another device without a session token, with any changes to their details passed on
+	identity = &models.Identity{ExternalID: "12345", Name: "Ann Marie", Email: "annmarie@nyaruka.com", Fields: map[string]string{"plan": "gold"}}
+
+	ann2, isNew, _, err := svc.StartChat(ctx, ch, "", "", identity)
+	assert.NoError(t, err)
+	assert.False(t, isNew)
+	assert.Equal(t, ann.ID, ann2.ID)
+	assert.Equal(t, "annmarie@nyaruka.com", ann2.Email)
+	assert.Len(t, mockCourier.Calls, 3)
+	assert.Equal(t, fmt.Sprintf(`UpdateContact(8291264a-4581-4d12-96e5-e9fcfa6e68d9, %d, {"name":"Ann Marie","fields":{"plan":"gold"}})`, ann.ID), mockCourier.Calls[2])
+}
+
+func TestLeaveMessage(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer func() { testsuite.ResetValkey(); testsuite.ResetDB() }()
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame"})
+
+	ch, err := models.LoadChannel(ctx, rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9")
+	require.NoError(t, err)
+
+	mockCourier := testsuite.NewMockCourier(rt)
+	svc := NewService(rt, mockCourier, testsuite.NewMockMailer(), testsuite.Attachments(rt))
+
+	contact, token, msgIn, err := svc.LeaveMessage(ctx, ch, "", "", "Ann", "ann@nyaruka.com", "Please call me back")
+	assert.NoError(t, err)
+	assert.Equal(t, "ann@nyaruka.com", contact.Email)
+	assert.Equal(t, "Please call me back", msgIn.Text)
+	assert.NoError(t, svc.ValidateSession(ctx, ch, contact.ChatID, token))
+	assert.Equal(t, []string{
+		fmt.Sprintf("StartChat(8291264a-4581-4d12-96e5-e9fcfa6e68d9, %s)", contact.ChatID),
+		fmt.Sprintf(`UpdateContact(8291264a-4581-4d12-96e5-e9fcfa6e68d9, %d, {"name":"Ann"})`, contact.ID),
+		fmt.Sprintf("CreateMsg(8291264a-4581-4d12-96e5-e9fcfa6e68d9, %d, 'Please call me back', [], open ticket)", contact.ID),
+	}, mockCourier.Calls)
+
+	// email is stored on the contact
+	contact, err = models.LoadContact(ctx, rt, orgID, contact.ChatID)
+	require.NoError(t, err)
+	assert.Equal(t, "ann@nyaruka.com", contact.Email)
+
+	// if creating the message fails, the started chat is still returned
+	mockCourier.Calls = nil
+	mockCourier.CreateMsgErr = errors.New("boom")
+
+	bob, token, _, err := svc.LeaveMessage(ctx, ch, "", "", "Bob", "bob@nyaruka.com", "Hello?")
+	assert.EqualError(t, err, "error notifying courier of new msg: boom")
+	require.NotNil(t, bob)
+	assert.NoError(t, svc.ValidateSession(ctx, ch, bob.ChatID, token))
+
+	// so that a retry can carry on with it rather than starting another chat
+	mockCourier.Calls = nil
+	mockCourier.CreateMsgErr = nil
+
+	contact, _, msgIn, err = svc.LeaveMessage(ctx, ch, bob.ChatID, token, "Bob", "bob@nyaruka.com", "Hello?")
+	assert.NoError(t, err)
+	assert.Equal(t, bob.ID, contact.ID)
+	assert.Equal(t, "Hello?", msgIn.Text)
+	assert.Equal(t, []string{
+		fmt.Sprintf(`UpdateContact(8291264a-4581-4d12-96e5-e9fcfa6e68d9, %d, {"name":"Bob"})`, bob.ID),
+		fmt.Sprintf("CreateMsg(8291264a-4581-4d12-96e5-e9fcfa6e68d9, %d, 'Hello?', [], open ticket)", bob.ID),
+	}, mockCourier.Calls)
+}
+
+func TestSweep(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer func() { testsuite.ResetValkey(); testsuite.ResetDB() }()
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	chID := testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame"})
+	annID := testsuite.InsertContact(rt, orgID, "Ann")
+	annURNID := testsuite.InsertURN(rt, orgID, annID, "webchat:65vbbDAQCdPdEWlEhDGy4utO")
+	bobID := testsuite.InsertContact(rt, orgID, "Bob")
+	bobURNID := testsuite.InsertURN(rt, orgID, bobID, "webchat:3xdF7KhyEiabBiCd3Cst3X28")
+	leahID := testsuite.InsertUser(rt, "leah@nyaruka.com", "Leah", "", "")
+
+	ch, err := models.LoadChannel(ctx, rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9")
+	require.NoError(t, err)
+	ann, err := models.LoadContact(ctx, rt, orgID, "65vbbDAQCdPdEWlEhDGy4utO")
+	require.NoError(t, err)
+	bob, err := models.LoadContact(ctx, rt, orgID, "3xdF7KhyEiabBiCd3Cst3X28")
+	require.NoError(t, err)
+	leah, err := models.LoadUser(ctx, rt, leahID)
+	require.NoError(t, err)
+
+	// ann has an email address so will be emailed her stale messages
+	require.NoError(t, ann.UpdateEmail(ctx, rt, "ann@nyaruka.com"))
+
+	mockCourier := testsuite.NewMockCourier(rt)
+	mockMailer := testsuite.NewMockMailer()
+	svc := NewService(rt, mockCourier, mockMailer, testsuite.Attachments(rt))
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	t1 := time.Date(2024, 1, 30, 12, 55, 0, 0, time.UTC)
+	t2 := time.Date(2024, 1, 30, 12, 56, 0, 0, time.UTC)
+	now := time.Now()
+
+	msg1ID := testsuite.InsertOutgoingMsg(rt, orgID, chID, annID, annURNID, "hi", t1)
+	msg2ID := testsuite.InsertOutgoingMsg(rt, orgID, chID, annID, annURNID, "how can I help", t2)
+	msg3ID := testsuite.InsertOutgoingMsg(rt, orgID, chID, bobID, bobURNID, "hola", t1)
+	msg4ID := testsuite.InsertOutgoingMsg(rt, orgID, chID, annID, annURNID, "still there?", now)
+	msg5ID := testsuite.InsertOutgoingMsg(rt, orgID, chID, bobID, bobURNID, "adios", t2)
+
+	require.NoError(t, svc.QueueMsgOut(ctx, ch, ann, models.NewMsgOut(msg1ID, "hi", nil, models.MsgOriginChat, leah, t1)))
+	require.NoError(t, svc.QueueMsgOut(ctx, ch, ann, models.NewMsgOut(msg2ID, "how can I help", nil, models.MsgOriginFlow, nil, t2)))
+	require.NoError(t, svc.QueueMsgOut(ctx, ch, bob, models.NewMsgOut(msg3ID, "hola", nil, models.MsgOriginFlow, nil, t1)))
+	require.NoError(t, svc.QueueMsgOut(ctx, ch, bob, models.NewMsgOut(msg5ID, "adios", nil, models.MsgOriginFlow, nil, t2)))
+
+	// ann's stale messages should be emailed to her, but bob's, which are failed in a single request, can't be failed if
+	// courier can't be reached...
+	mockCourier.Err = errors.New("boom")
+	svc.sweep()
+
+	assert.Equal(t, []string{"Send(ann@nyaruka.com, 'You have unread messages', '[2024-01-30 12:55] Leah: hi\n[2024-01-30 12:56] Support: how can I help\n')"}, mockMailer.Calls)
+	assert.Equal(t, []string{"ReportStatus(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 2, [3 5], failed)"}, mockCourier.Calls)
+	assertvk.ZGetAll(t, rc, "chat:outboxes", map[string]float64{"3xdF7KhyEiabBiCd3Cst3X28@8291264a-4581-4d12-96e5-e9fcfa6e68d9": float64(t1.UnixMilli())})
+
+	// so they're kept and failed on the next sweep
+	mockCourier.Err = nil
+	svc.sweep()
+
+	assert.Len(t, mockMailer.Calls, 1)
+	assert.Equal(t, []string{"ReportStatus(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 2, [3 5], failed)", "ReportStatus(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 2, [3 5], failed)"}, mockCourier.Calls)
+	assertvk.ZGetAll(t, rc, "chat:outboxes", map[string]float64{})
+
+	// queue a recent message which shouldn't be swept
+	require.NoError(t, svc.QueueMsgOut(ctx, ch, ann, models.NewMsgOut(msg4ID, "still there?", nil, models.MsgOriginChat, leah, now)))
+
+	svc.sweep()
+
+	assert.Len(t, mockMailer.Calls, 1)
+	assert.Len(t, mockCourier.Calls, 2)
+	assertvk.ZGetAll(t, rc, "chat:outboxes", map[string]float64{"65vbbDAQCdPdEWlEhDGy4utO@8291264a-4581-4d12-96e5-e9fcfa6e68d9": float64(now.UnixMilli())})
+}
+
+func TestExpire(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer func() { testsuite.ResetValkey(); testsuite.ResetDB() }()
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	chID := testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame"})
+	annID := testsuite.InsertContact(rt, orgID, "Ann")
+	annURNID := testsuite.InsertURN(rt, orgID, annID, "webchat:65vbbDAQCdPdEWlEhDGy4utO")
+
+	ch, err := models.LoadChannel(ctx, rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9")
+	require.NoError(t, err)
+	ann, err := models.LoadContact(ctx, rt, orgID, "65vbbDAQCdPdEWlEhDGy4utO")
+	require.NoError(t, err)
+
+	mockCourier := testsuite.NewMockCourier(rt)
+	svc := NewService(rt, mockCourier, testsuite.NewMockMailer(), testsuite.Attachments(rt))
+
+	// don't wait for acknowledgements or retry sending
+	svc.outboxes.Timeout = 0
+	svc.outboxes.MaxRetries = 0
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	msg1ID := testsuite.InsertOutgoingMsg(rt, orgID, chID, annID, annURNID, "hi", time.Now())
+	require.NoError(t, svc.QueueMsgOut(ctx, ch, ann, models.NewMsgOut(msg1ID, "hi", nil, models.MsgOriginFlow, nil, time.Now())))
+	require.NoError(t, svc.outboxes.SetReady(rc, ch, ann.ChatID, true))
+
+	svc.send()
+
+	// message was never acknowledged so should be failed
+	svc.expire()
+
+	assert.Equal(t, []string{"ReportStatus(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, [1], failed)"}, mockCourier.Calls)
+	assertvk.ZGetAll(t, rc, "chat:outboxes", map[string]float64{})
+}
+
+func TestCheckAvailability(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer func() { testsuite.ResetValkey(); testsuite.ResetDB() }()
+
+	// channel is only open on the day after tomorrow, so it's offline now whatever the time
+	day := time.Now().UTC().AddDate(0, 0, 2)
+	opens := time.Date(day.Year(), day.Month(), day.Day(), 8, 0, 0, 0, time.UTC)
+	closes := opens.Add(9 * time.Hour)
+	weekday := strings.ToLower(day.Weekday().String()[:3])
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame", "schedule": map[string]any{"timezone": "UTC", "hours": map[string]any{weekday: []any{"08:00-17:00"}}}})
+
+	svc := NewService(rt, testsuite.NewMockCourier(rt), testsuite.NewMockMailer(), testsuite.Attachments(rt))
+	require.NoError(t, svc.Start())
+
+	defer svc.Stop()
+
+	client := testsuite.NewClient(t, "ws://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/")
+	time.Sleep(100 * time.Millisecond)
+
+	// nothing changes before the channel opens...
+	svc.server.CheckAvailability(opens.Add(-time.Minute))
+
+	// but once it opens, the client is told it's online
+	svc.server.CheckAvailability(opens)
+	assert.JSONEq(t, `{"type": "availability_changed", "online": true}`, client.Read(t))
+
+	// and once it closes, that it's offline until the same day next week
+	svc.server.CheckAvailability(closes.Add(-time.Minute))
+	svc.server.CheckAvailability(closes)
+	assert.JSONEq(t, fmt.Sprintf(`{"type": "availability_changed", "online": false, "opens_on": "%s"}`, opens.AddDate(0, 0, 7).Format(time.RFC3339)), client.Read(t))
+
+	// if the schedule is removed, the client is told it's online without having to reconnect
+	_, err := rt.DB.Exec(`UPDATE channels_channel SET config = config - 'schedule'`)
+	require.NoError(t, err)
+
+	// replace the store so the change is seen without waiting for the cached channel to expire
+	svc.store.Stop()
+	svc.store = models.NewStore(rt)
+	svc.store.Start()
+
+	svc.server.CheckAvailability(closes.Add(time.Minute))
+	assert.JSONEq(t, `{"type": "availability_changed", "online": true}`, client.Read(t))
+
+	client.Close(t)
+	time.Sleep(100 * time.Millisecond)
+}
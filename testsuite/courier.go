@@ -4,43 +4,103 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/lib/pq"
+	"github.com/nyaruka/chip/core/courier"
 	"github.com/nyaruka/chip/core/models"
 	"github.com/nyaruka/chip/runtime"
 	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/urns"
 )
 
 type MockCourier struct {
 	rt    *runtime.Runtime
 	Calls []string
+	Err   error // if set, calls are recorded but fail with this error
+
+	CreateMsgErr error // if set, only CreateMsg calls fail with this error
 }
 
 func NewMockCourier(rt *runtime.Runtime) *MockCourier {
 	return &MockCourier{rt: rt}
 }
 
-func (c *MockCourier) StartChat(ctx context.Context, ch *models.Channel, chatID models.ChatID) error {
-	c.Calls = append(c.Calls, fmt.Sprintf("StartChat(%s, %s)", ch.UUID, chatID))
+func (c *MockCourier) StartChat(ctx context.Context, ch *models.Channel, chatID models.ChatID, identity *models.Identity) error {
+	var name string
+	if identity != nil {
+		c.Calls = append(c.Calls, fmt.Sprintf("StartChat(%s, %s, %s)", ch.UUID, chatID, identity.ExternalID))
+		name = identity.Name
+	} else {
+		c.Calls = append(c.Calls, fmt.Sprintf("StartChat(%s, %s)", ch.UUID, chatID))
+	}
+	if c.Err != nil {
+		return c.Err
+	}
 
-	cid := InsertContact(c.rt, ch.OrgID, "")
+	cid := InsertContact(c.rt, ch.OrgID, name)
 	InsertURN(c.rt, ch.OrgID, cid, urns.URN(fmt.Sprintf("webchat:%s", chatID)))
 
 	return nil
 }
 
-func (c *MockCourier) CreateMsg(ctx context.Context, ch *models.Channel, contact *models.Contact, text string) error {
-	c.Calls = append(c.Calls, fmt.Sprintf("CreateMsg(%s, %d, '%s')", ch.UUID, contact.ID, text))
+func (c *MockCourier) CreateMsg(ctx context.Context, ch *models.Channel, contact *models.Contact, text string, attachments []string, replyTo models.MsgID, flags courier.MsgFlags) (*models.MsgIn, error) {
+	call := fmt.Sprintf("CreateMsg(%s, %d, '%s', %v", ch.UUID, contact.ID, text, attachments)
+	if replyTo != models.NilMsgID {
+		call += fmt.Sprintf(", %d", replyTo)
+	}
+	if flags.OutOfHours {
+		call += ", out of hours"
+	}
+	if flags.OpenTicket {
+		call += ", open ticket"
+	}
+	c.Calls = append(c.Calls, call+")")
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	if c.CreateMsgErr != nil {
+		return nil, c.CreateMsgErr
+	}
 
-	InsertIncomingMsg(c.rt, ch.OrgID, ch.ID, contact.ID, contact.URNID, text, dates.Now())
+	createdOn := dates.Now()
+	msgID := InsertIncomingMsg(c.rt, ch.OrgID, ch.ID, contact.ID, contact.URNID, text, createdOn)
 
-	return nil
+	return &models.MsgIn{ID: msgID, Text: text, Attachments: attachments, Time: createdOn, ReplyTo: replyTo}, nil
+}
+
+var mockStatusCodes = map[courier.MsgStatus]string{
+	courier.MsgStatusDelivered: "D",
+	courier.MsgStatusRead:      "R",
+	courier.MsgStatusErrored:   "E",
+	courier.MsgStatusFailed:    "F",
 }
 
-func (c *MockCourier) ReportDelivered(ctx context.Context, ch *models.Channel, contact *models.Contact, msgID models.MsgID) error {
-	c.Calls = append(c.Calls, fmt.Sprintf("ReportDelivered(%s, %d, %d)", ch.UUID, contact.ID, msgID))
+func (c *MockCourier) ReportStatus(ctx context.Context, ch *models.Channel, contact *models.Contact, msgIDs []models.MsgID, status courier.MsgStatus) error {
+	c.Calls = append(c.Calls, fmt.Sprintf("ReportStatus(%s, %d, %v, %s)", ch.UUID, contact.ID, msgIDs, status))
+	if c.Err != nil {
+		return c.Err
+	}
 
-	_, err := c.rt.DB.ExecContext(context.Background(), `UPDATE msgs_msg SET status = 'D', modified_on = NOW() WHERE id = $1 AND channel_id = $2`, msgID, ch.ID)
+	_, err := c.rt.DB.ExecContext(context.Background(), `UPDATE msgs_msg SET status = $3, modified_on = NOW() WHERE id = ANY($1) AND channel_id = $2`, pq.Array(msgIDs), ch.ID, mockStatusCodes[status])
 	noError(err)
 
 	return nil
 }
+
+func (c *MockCourier) ReportTyping(ctx context.Context, ch *models.Channel, contact *models.Contact) error {
+	c.Calls = append(c.Calls, fmt.Sprintf("ReportTyping(%s, %d)", ch.UUID, contact.ID))
+	if c.Err != nil {
+		return c.Err
+	}
+
+	return nil
+}
+
+func (c *MockCourier) UpdateContact(ctx context.Context, ch *models.Channel, contact *models.Contact, update *models.ContactUpdate) error {
+	c.Calls = append(c.Calls, fmt.Sprintf("UpdateContact(%s, %d, %s)", ch.UUID, contact.ID, jsonx.MustMarshal(update)))
+	if c.Err != nil {
+		return c.Err
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+package testsuite
+
+import (
+	"context"
+	"fmt"
+)
+
+type MockMailer struct {
+	Calls []string
+}
+
+func NewMockMailer() *MockMailer {
+	return &MockMailer{}
+}
+
+func (m *MockMailer) Send(ctx context.Context, to, subject, body string) error {
+	m.Calls = append(m.Calls, fmt.Sprintf("Send(%s, '%s', '%s')", to, subject, body))
+
+	return nil
+}
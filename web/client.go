@@ -2,13 +2,16 @@ package web
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nyaruka/chip/core/models"
 	"github.com/nyaruka/chip/core/queue"
+	"github.com/nyaruka/chip/core/sessions"
 	"github.com/nyaruka/chip/web/commands"
 	"github.com/nyaruka/chip/web/events"
 	"github.com/nyaruka/gocommon/httpx"
@@ -18,19 +21,24 @@ import (
 
 type Client struct {
 	id      string
+	ip      string
 	server  *Server
 	socket  httpx.WebSocket
 	channel *models.Channel
-	contact *models.Contact
+	contact atomic.Pointer[models.Contact] // set when chat is started, and read when sending
+
+	availability atomic.Pointer[models.Availability]
+	pendingChat  atomic.Pointer[pendingChat] // chat started by a leave_message command which then failed
 
 	send     chan events.Event
 	sendStop chan bool
 	sendWait sync.WaitGroup
 }
 
-func NewClient(s *Server, sock httpx.WebSocket, channel *models.Channel) *Client {
+func NewClient(s *Server, sock httpx.WebSocket, channel *models.Channel, ip string) *Client {
 	c := &Client{
 		id:      string(uuids.NewV4()),
+		ip:      ip,
 		server:  s,
 		socket:  sock,
 		channel: channel,
@@ -39,6 +47,8 @@ func NewClient(s *Server, sock httpx.WebSocket, channel *models.Channel) *Client
 		sendStop: make(chan bool),
 	}
 
+	c.availability.Store(channel.Availability(time.Now()))
+
 	c.socket.OnMessage(c.onMessage)
 	c.socket.OnClose(c.onClose)
 	c.socket.Start()
@@ -48,79 +58,293 @@ func NewClient(s *Server, sock httpx.WebSocket, channel *models.Channel) *Client
 	return c
 }
 
+// a chat which has been started but not yet stored as the client's chat
+type pendingChat struct {
+	chatID models.ChatID
+	token  string
+}
+
+// number of messages in a page of history if the client doesn't specify a limit
+const defaultHistoryLimit = 25
+
+// clientError is an error caused by the client which is reported back to it with a code it can rely on
+type clientError struct {
+	code    string
+	message string
+}
+
+func (e *clientError) Error() string { return e.message }
+
+var (
+	errChatNotStarted     = &clientError{code: events.ErrorCodeChatNotStarted, message: "chat not started"}
+	errChatAlreadyStarted = &clientError{code: events.ErrorCodeChatAlreadyStarted, message: "chat already started"}
+	errInvalidToken       = &clientError{code: events.ErrorCodeInvalidToken, message: "invalid session token"}
+	errInvalidAttachment  = &clientError{code: events.ErrorCodeInvalidAttachment, message: "attachment not uploaded by contact"}
+	errInvalidCursor      = &clientError{code: events.ErrorCodeInvalidCommand, message: "invalid cursor"}
+	errInvalidReplyTo     = &clientError{code: events.ErrorCodeInvalidCommand, message: "invalid reply_to"}
+	errRateLimited        = &clientError{code: events.ErrorCodeRateLimited, message: "too many requests, try again later"}
+	errCommandInProgress  = &clientError{code: events.ErrorCodeCommandInProgress, message: "command is still being handled"}
+)
+
 func (c *Client) onMessage(msg []byte) {
 	log := c.log()
 
 	cmd, err := commands.ReadCommand(msg)
 	if err != nil {
-		log.Error("unable to unmarshal command", "error", err)
+		log.Debug("unable to read command", "error", err)
+
+		code := events.ErrorCodeInvalidCommand
+		if errors.Is(err, commands.ErrUnknownType) {
+			code = events.ErrorCodeUnknownCommand
+		}
+
+		if cmd != nil {
+			c.reply(cmd, events.NewError(code, err.Error(), cmd.Type()))
+		} else {
+			c.Send(events.NewError(code, err.Error(), ""))
+		}
 		return
 	}
 
 	if err = c.onCommand(cmd); err != nil {
-		log.Error("error handling command", "command", cmd.Type(), "error", err)
+		var cerr *clientError
+		if errors.As(err, &cerr) {
+			log.Debug("command rejected", "command", cmd.Type(), "error", err)
+
+			c.reply(cmd, events.NewError(cerr.code, cerr.message, cmd.Type()))
+		} else {
+			log.Error("error handling command", "command", cmd.Type(), "error", err)
+
+			// don't leak internal errors to the client
+			c.reply(cmd, events.NewError(events.ErrorCodeServerError, "unable to handle command, try again later", cmd.Type()))
+		}
 	}
 }
 
 func (c *Client) onCommand(cmd commands.Command) error {
-	log := c.log().With("command", cmd.Type())
+	contact := c.contact.Load()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	// chat starts and messages are rate limited, and the client is told when it's over the limit
+	if cmd.Type() == commands.TypeStartChat || cmd.Type() == commands.TypeSendMsg || cmd.Type() == commands.TypeLeaveMessage {
+		if !c.server.checkRateLimit(c.channel, cmd.Type(), c.ip, c.id) {
+			return errRateLimited
+		}
+	}
+
 	switch typed := cmd.(type) {
 	case *commands.StartChat:
-		if c.contact != nil {
-			log.Debug("chat already started, command ignored")
-			return nil
+		if contact != nil {
+			return errChatAlreadyStarted
 		}
 
-		contact, isNew, err := c.server.service.StartChat(ctx, c.channel, typed.ChatID)
-		if err != nil {
+		var identity *models.Identity
+		if typed.Identity != "" {
+			var err error
+			identity, err = models.ParseIdentity(c.channel, typed.Identity)
+			if err != nil {
+				return &clientError{code: events.ErrorCodeInvalidIdentity, message: fmt.Sprintf("invalid identity: %s", err)}
+			}
+		}
+
+		started, isNew, token, err := c.server.service.StartChat(ctx, c.channel, typed.ChatID, typed.Token, identity)
+		if errors.Is(err, sessions.ErrInvalidToken) {
+			return errInvalidToken
+		} else if err != nil {
 			return fmt.Errorf("error from service: %w", err)
 		}
 
-		c.contact = contact
+		c.contact.Store(started)
+		c.server.OnChatStarted(c)
 
 		if isNew {
-			c.Send(events.NewChatStarted(contact.ChatID))
+			c.reply(cmd, events.NewChatStarted(started.ChatID, token, c.availability.Load()))
 		} else {
-			c.Send(events.NewChatResumed(contact.ChatID, contact.Email))
+			c.reply(cmd, events.NewChatResumed(started.ChatID, started.Email, token, c.availability.Load()))
 		}
 
 	case *commands.SendMsg:
-		if c.contact == nil {
-			log.Debug("chat not started, command ignored")
-			return nil
+		if contact == nil {
+			return errChatNotStarted
 		}
 
-		if err := c.server.service.CreateMsgIn(ctx, c.channel, c.contact, typed.Text); err != nil {
+		// a retried command is only handled once, but gets the same response
+		if typed.ID() != "" {
+			claimed, response, err := c.server.claimCommand(c.channel, contact.ChatID, typed.ID())
+			if err != nil {
+				return fmt.Errorf("error claiming command: %w", err)
+			}
+			if !claimed {
+				// if the first attempt hasn't finished, the client should wait for its response
+				if len(response) == 0 {
+					return errCommandInProgress
+				}
+
+				created := &events.MsgInCreated{}
+				jsonx.MustUnmarshal(response, created)
+				c.Send(created)
+				return nil
+			}
+		}
+
+		msgIn, err := c.server.service.CreateMsgIn(ctx, c.channel, contact, typed.Text, typed.Attachments, typed.ReplyTo)
+		if err != nil {
+			// allow the client to retry
+			c.server.releaseCommand(c.channel, contact.ChatID, typed.ID())
+
+			if errors.Is(err, models.ErrAttachmentNotUploaded) {
+				return errInvalidAttachment
+			} else if errors.Is(err, models.ErrInvalidReplyTo) {
+				return errInvalidReplyTo
+			}
+			return fmt.Errorf("error from service: %w", err)
+		}
+
+		created := events.NewMsgInCreated(msgIn.ID, msgIn.Time)
+		c.reply(cmd, created)
+		c.server.completeCommand(c.channel, contact.ChatID, typed.ID(), created)
+
+		// send message to all clients for this chat, including this one, so that their transcripts match
+		if err := c.server.service.NotifyMsgIn(ctx, c.channel, contact, msgIn); err != nil {
+			c.log().Error("error notifying clients of msg", "error", err)
+		}
+
+	case *commands.LeaveMessage:
+		// a retried command is only handled once, but gets the same response. There's no chat yet to scope the command
+		// to so it's scoped to this socket, which means nobody else can replay it to get the session token.
+		scope := models.ChatID("leave-" + c.id)
+
+		if typed.ID() != "" {
+			claimed, response, err := c.server.claimCommand(c.channel, scope, typed.ID())
+			if err != nil {
+				return fmt.Errorf("error claiming command: %w", err)
+			}
+			if !claimed {
+				if len(response) == 0 {
+					return errCommandInProgress
+				}
+
+				left := &events.MessageLeft{}
+				jsonx.MustUnmarshal(response, left)
+				c.Send(left)
+				return nil
+			}
+		}
+
+		if contact != nil {
+			c.server.releaseCommand(c.channel, scope, typed.ID())
+			return errChatAlreadyStarted
+		}
+
+		// if a previous attempt started a chat before failing, carry on with that chat rather than starting another
+		var chatID models.ChatID
+		var token string
+		if pending := c.pendingChat.Load(); pending != nil {
+			chatID, token = pending.chatID, pending.token
+		}
+
+		started, token, msgIn, err := c.server.service.LeaveMessage(ctx, c.channel, chatID, token, typed.Name, typed.Email, typed.Text)
+		if err != nil {
+			if started != nil {
+				c.pendingChat.Store(&pendingChat{chatID: started.ChatID, token: token})
+			}
+
+			// allow the client to retry
+			c.server.releaseCommand(c.channel, scope, typed.ID())
 			return fmt.Errorf("error from service: %w", err)
 		}
 
+		// visitor can resume this chat later to see any replies
+		c.pendingChat.Store(nil)
+		c.contact.Store(started)
+		c.server.OnChatStarted(c)
+
+		left := events.NewMessageLeft(started.ChatID, token, msgIn.ID, msgIn.Time)
+		c.reply(cmd, left)
+		c.server.completeCommand(c.channel, scope, typed.ID(), left)
+
 	case *commands.AckChat:
-		if c.contact == nil {
-			log.Debug("chat not started, command ignored")
-			return nil
+		if contact == nil {
+			return errChatNotStarted
 		}
 
-		// for now all acks are msg ids
 		itemID := queue.ItemID(fmt.Sprintf("m%d", typed.MsgID))
+		if typed.EventUUID != "" {
+			itemID = queue.ItemID(fmt.Sprintf("e%s", typed.EventUUID))
+		}
 
-		if err := c.server.service.ConfirmDelivery(ctx, c.channel, c.contact, itemID); err != nil {
+		if err := c.server.service.ConfirmDelivery(ctx, c.channel, contact, itemID); err != nil {
+			return fmt.Errorf("error from service: %w", err)
+		}
+
+	case *commands.MarkRead:
+		if contact == nil {
+			return errChatNotStarted
+		}
+
+		if err := c.server.service.MarkRead(ctx, c.channel, contact, typed.MsgID, typed.Time); err != nil {
+			return fmt.Errorf("error from service: %w", err)
+		}
+
+	case *commands.Typing:
+		if contact == nil {
+			return errChatNotStarted
+		}
+
+		if err := c.server.service.ReportTyping(ctx, c.channel, contact); err != nil {
 			return fmt.Errorf("error from service: %w", err)
 		}
 
 	case *commands.GetHistory:
-		if c.contact == nil {
-			log.Debug("chat not started, command ignored")
-			return nil
+		if contact == nil {
+			return errChatNotStarted
 		}
 
-		msgs, err := models.LoadContactMessages(ctx, c.server.rt, c.contact.ID, typed.Before, 25)
-		if err != nil {
-			return fmt.Errorf("error loading contact messages: %w", err)
+		// the session was validated when this client started or resumed the chat, so history can be read until it's
+		// revoked, even if the token this client was issued has since been replaced by another client
+		if revoked, err := c.server.service.SessionRevoked(ctx, c.channel, contact.ChatID); err != nil {
+			return fmt.Errorf("error checking session: %w", err)
+		} else if revoked {
+			return errInvalidToken
+		}
+
+		limit := typed.Limit
+		if limit == 0 {
+			limit = defaultHistoryLimit
+		}
+		limit = min(limit, c.server.rt.Config.HistoryLimit)
 
+		var msgs []*models.DBMsg
+		var hasMore bool
+		var cursor *models.MsgCursor
+		var err error
+
+		if typed.After != "" {
+			// paging forwards, e.g. to catch up after reconnecting, so next page starts after the newest message
+			if cursor, err = models.ParseMsgCursor(typed.After); err != nil {
+				return errInvalidCursor
+			}
+			if msgs, hasMore, err = models.LoadContactMessagesAfter(ctx, c.server.rt, contact.ID, cursor, limit); err != nil {
+				return fmt.Errorf("error loading contact messages: %w", err)
+			}
+			if len(msgs) > 0 {
+				cursor = msgs[0].Cursor()
+			}
+		} else {
+			// paging backwards, so next page starts before the oldest message
+			if typed.Before != "" {
+				if cursor, err = models.ParseMsgCursor(typed.Before); err != nil {
+					return errInvalidCursor
+				}
+			}
+			if msgs, hasMore, err = models.LoadContactMessages(ctx, c.server.rt, contact.ID, cursor, limit); err != nil {
+				return fmt.Errorf("error loading contact messages: %w", err)
+			}
+			if len(msgs) > 0 {
+				cursor = msgs[len(msgs)-1].Cursor()
+			}
 		}
 
 		history := make([]*events.HistoryItem, len(msgs))
@@ -137,39 +361,99 @@ func (c *Client) onCommand(cmd commands.Command) error {
 			}
 		}
 
-		c.Send(events.NewHistory(history))
+		var next string
+		if cursor != nil {
+			next = cursor.String()
+		}
+
+		c.reply(cmd, events.NewHistory(history, hasMore, next))
 
 	case *commands.SetEmail:
-		if c.contact == nil {
-			log.Debug("chat not started, command ignored")
-			return nil
+		if contact == nil {
+			return errChatNotStarted
 		}
 
-		if err := c.contact.UpdateEmail(ctx, c.server.rt, typed.Email); err != nil {
+		if err := contact.UpdateEmail(ctx, c.server.rt, typed.Email); err != nil {
 			return fmt.Errorf("error updating email: %w", err)
 		}
+
+	case *commands.SetName:
+		return c.updateContact(ctx, &models.ContactUpdate{Name: typed.Name})
+
+	case *commands.SetLanguage:
+		return c.updateContact(ctx, &models.ContactUpdate{Language: typed.Language})
+
+	case *commands.SetFields:
+		return c.updateContact(ctx, &models.ContactUpdate{Fields: typed.Fields})
 	}
 
 	return nil
 }
 
+func (c *Client) updateContact(ctx context.Context, update *models.ContactUpdate) error {
+	contact := c.contact.Load()
+	if contact == nil {
+		return errChatNotStarted
+	}
+
+	if err := c.server.service.UpdateContact(ctx, c.channel, contact, update); err != nil {
+		if errors.Is(err, models.ErrFieldNotAllowed) {
+			return &clientError{code: events.ErrorCodeFieldNotAllowed, message: err.Error()}
+		}
+		return fmt.Errorf("error from service: %w", err)
+	}
+	return nil
+}
+
+// checks whether the given channel has passed a schedule boundary or had its schedule changed, and if so lets the client
+// know it's now online or offline
+func (c *Client) checkAvailability(ch *models.Channel, now time.Time) {
+	current := c.availability.Load()
+	updated := ch.Availability(now)
+	c.availability.Store(updated)
+
+	if updated.Online != current.Online {
+		c.Send(events.NewAvailabilityChanged(updated))
+	}
+}
+
 func (c *Client) onClose(code int) {
 	c.log().Info("closing", "code", code)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	if c.contact != nil {
-		c.server.service.CloseChat(ctx, c.channel, c.contact)
+	// only close the chat if this was the last client for it
+	if last := c.server.OnDisconnect(c); last {
+		if contact := c.contact.Load(); contact != nil {
+			c.server.service.CloseChat(ctx, c.channel, contact)
+		}
 	}
 
-	c.server.OnDisconnect(c)
+	close(c.sendStop)
+}
 
-	c.sendStop <- true
+// sends an event in response to the given command, including the command's ID so the client can match them up
+func (c *Client) reply(cmd commands.Command, e events.Event) {
+	e.SetCommandID(cmd.ID())
+	c.Send(e)
 }
 
+// Send queues the given event to be written to the socket
 func (c *Client) Send(e events.Event) {
-	c.send <- e
+	// check first if client is closing as select below doesn't prioritize
+	select {
+	case <-c.sendStop:
+		c.onSendError(e, errors.New("client is closed"))
+		return
+	default:
+	}
+
+	select {
+	case c.send <- e:
+	case <-c.sendStop:
+		c.onSendError(e, errors.New("client is closed"))
+	}
 }
 
 func (c *Client) Stop() {
@@ -185,16 +469,42 @@ func (c *Client) sender() {
 	for {
 		select {
 		case e := <-c.send:
-			c.socket.Send(jsonx.MustMarshal(e))
+			if err := c.write(e); err != nil {
+				c.onSendError(e, err)
+			}
 		case <-c.sendStop:
 			return
 		}
 	}
 }
 
+func (c *Client) write(e events.Event) (err error) {
+	// socket panics if we try to write to it after it's started closing
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error writing to socket: %v", r)
+		}
+	}()
+
+	c.socket.Send(jsonx.MustMarshal(e))
+	return nil
+}
+
+// called when an event couldn't be sent, and if it's a message, queues it to be reported to courier
+func (c *Client) onSendError(e events.Event, err error) {
+	log := c.log().With("event", e.Type())
+	log.Error("error sending event", "error", err)
+
+	if out, ok := e.(*events.ChatOutEvent); ok && out.MsgOut != nil {
+		if contact := c.contact.Load(); contact != nil {
+			c.server.queueSendError(c, contact, queue.ItemID(fmt.Sprintf("m%d", out.MsgOut.ID)))
+		}
+	}
+}
+
 func (c *Client) chatID() models.ChatID {
-	if c.contact != nil {
-		return c.contact.ChatID
+	if contact := c.contact.Load(); contact != nil {
+		return contact.ChatID
 	}
 	return ""
 }
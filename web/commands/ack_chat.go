@@ -1,6 +1,9 @@
 package commands
 
-import "github.com/nyaruka/chip/core/models"
+import (
+	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/gocommon/uuids"
+)
 
 func init() {
 	registerType(TypeAckChat, func() Command { return &AckChat{} })
@@ -11,5 +14,6 @@ const TypeAckChat string = "ack_chat"
 type AckChat struct {
 	baseCommand
 
-	MsgID models.MsgID `json:"msg_id" validate:"required"`
+	MsgID     models.MsgID `json:"msg_id"     validate:"required_without=EventUUID"`
+	EventUUID uuids.UUID   `json:"event_uuid" validate:"omitempty,uuid"`
 }
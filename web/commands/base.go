@@ -2,6 +2,7 @@ package commands
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/go-playground/validator/v10"
@@ -12,6 +13,9 @@ var valx = validator.New()
 
 var registeredTypes = map[string](func() Command){}
 
+// ErrUnknownType is returned when reading a command whose type isn't registered
+var ErrUnknownType = errors.New("unknown command type")
+
 // registers a new type of event
 func registerType(name string, initFunc func() Command) {
 	registeredTypes[name] = initFunc
@@ -19,16 +23,25 @@ func registerType(name string, initFunc func() Command) {
 
 type Command interface {
 	Type() string
+	ID() string
 }
 
 type baseCommand struct {
 	Type_ string `json:"type" validate:"required"`
+	ID_   string `json:"id"   validate:"max=64"`
 }
 
 func (e *baseCommand) Type() string {
 	return e.Type_
 }
 
+// ID returns the optional ID provided by the client which is included on any events sent in response
+func (e *baseCommand) ID() string {
+	return e.ID_
+}
+
+// ReadCommand reads and validates a command. If the command can be read but isn't valid, it's returned with the error so
+// that callers can still get its type.
 func ReadCommand(d []byte) (Command, error) {
 	be := &baseCommand{}
 	if err := json.Unmarshal(d, be); err != nil {
@@ -37,7 +50,7 @@ func ReadCommand(d []byte) (Command, error) {
 
 	f := registeredTypes[be.Type_]
 	if f == nil {
-		return nil, fmt.Errorf("unknown command type '%s'", be.Type_)
+		return be, fmt.Errorf("%w '%s'", ErrUnknownType, be.Type_)
 	}
 
 	e := f()
@@ -1,7 +1,5 @@
 package commands
 
-import "time"
-
 func init() {
 	registerType(TypeGetHistory, func() Command { return &GetHistory{} })
 }
@@ -11,5 +9,7 @@ const TypeGetHistory string = "get_history"
 type GetHistory struct {
 	baseCommand
 
-	Before time.Time `json:"before" validate:"required"`
+	Before string `json:"before" validate:"excluded_with=After"`
+	After  string `json:"after"`
+	Limit  int    `json:"limit"  validate:"min=0"`
 }
@@ -0,0 +1,15 @@
+package commands
+
+func init() {
+	registerType(TypeLeaveMessage, func() Command { return &LeaveMessage{} })
+}
+
+const TypeLeaveMessage string = "leave_message"
+
+type LeaveMessage struct {
+	baseCommand
+
+	Name  string `json:"name"  validate:"required,max=128"`
+	Email string `json:"email" validate:"required,email"`
+	Text  string `json:"text"  validate:"required"`
+}
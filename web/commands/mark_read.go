@@ -0,0 +1,20 @@
+package commands
+
+import (
+	"time"
+
+	"github.com/nyaruka/chip/core/models"
+)
+
+func init() {
+	registerType(TypeMarkRead, func() Command { return &MarkRead{} })
+}
+
+const TypeMarkRead string = "mark_read"
+
+type MarkRead struct {
+	baseCommand
+
+	MsgID models.MsgID `json:"msg_id" validate:"required_without=Time"`
+	Time  time.Time    `json:"time"   validate:"required_without=MsgID"`
+}
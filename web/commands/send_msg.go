@@ -1,5 +1,7 @@
 package commands
 
+import "github.com/nyaruka/chip/core/models"
+
 func init() {
 	registerType(TypeSendMsg, func() Command { return &SendMsg{} })
 }
@@ -9,5 +11,7 @@ const TypeSendMsg string = "send_msg"
 type SendMsg struct {
 	baseCommand
 
-	Text string `json:"text" validate:"required"`
+	Text        string       `json:"text"        validate:"required_without=Attachments"`
+	Attachments []string     `json:"attachments" validate:"max=10,dive,url"`
+	ReplyTo     models.MsgID `json:"reply_to"`
 }
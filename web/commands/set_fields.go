@@ -0,0 +1,13 @@
+package commands
+
+func init() {
+	registerType(TypeSetFields, func() Command { return &SetFields{} })
+}
+
+const TypeSetFields string = "set_fields"
+
+type SetFields struct {
+	baseCommand
+
+	Fields map[string]string `json:"fields" validate:"required,min=1,dive,keys,required,max=36,endkeys,max=640"`
+}
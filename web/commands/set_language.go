@@ -0,0 +1,13 @@
+package commands
+
+func init() {
+	registerType(TypeSetLanguage, func() Command { return &SetLanguage{} })
+}
+
+const TypeSetLanguage string = "set_language"
+
+type SetLanguage struct {
+	baseCommand
+
+	Language string `json:"language" validate:"required,len=3"`
+}
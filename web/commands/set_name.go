@@ -0,0 +1,13 @@
+package commands
+
+func init() {
+	registerType(TypeSetName, func() Command { return &SetName{} })
+}
+
+const TypeSetName string = "set_name"
+
+type SetName struct {
+	baseCommand
+
+	Name string `json:"name" validate:"required,max=128"`
+}
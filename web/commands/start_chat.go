@@ -11,5 +11,7 @@ const TypeStartChat string = "start_chat"
 type StartChat struct {
 	baseCommand
 
-	ChatID models.ChatID `json:"chat_id"`
+	ChatID   models.ChatID `json:"chat_id"`
+	Token    string        `json:"token"`
+	Identity string        `json:"identity"`
 }
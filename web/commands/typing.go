@@ -0,0 +1,11 @@
+package commands
+
+func init() {
+	registerType(TypeTyping, func() Command { return &Typing{} })
+}
+
+const TypeTyping string = "typing"
+
+type Typing struct {
+	baseCommand
+}
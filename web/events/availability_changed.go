@@ -0,0 +1,20 @@
+package events
+
+import (
+	"time"
+
+	"github.com/nyaruka/chip/core/models"
+)
+
+const TypeAvailabilityChanged string = "availability_changed"
+
+type AvailabilityChanged struct {
+	baseEvent
+
+	Online  bool       `json:"online"`
+	OpensOn *time.Time `json:"opens_on,omitempty"`
+}
+
+func NewAvailabilityChanged(availability *models.Availability) *AvailabilityChanged {
+	return &AvailabilityChanged{baseEvent: baseEvent{Type_: TypeAvailabilityChanged}, Online: availability.Online, OpensOn: availability.OpensOn()}
+}
@@ -2,10 +2,15 @@ package events
 
 type Event interface {
 	Type() string
+	SetCommandID(string)
 }
 
 type baseEvent struct {
-	Type_ string `json:"type"`
+	Type_      string `json:"type"`
+	CommandID_ string `json:"command_id,omitempty"`
 }
 
 func (e *baseEvent) Type() string { return e.Type_ }
+
+// SetCommandID sets the ID of the command that this event is a response to
+func (e *baseEvent) SetCommandID(id string) { e.CommandID_ = id }
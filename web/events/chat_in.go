@@ -0,0 +1,18 @@
+package events
+
+import "github.com/nyaruka/chip/core/models"
+
+const TypeChatIn string = "chat_in"
+
+type ChatInEvent struct {
+	baseEvent
+
+	MsgIn *models.MsgIn `json:"msg_in,omitempty"`
+}
+
+func NewChatMsgIn(msgIn *models.MsgIn) *ChatInEvent {
+	return &ChatInEvent{
+		baseEvent: baseEvent{Type_: TypeChatIn},
+		MsgIn:     msgIn,
+	}
+}
@@ -1,6 +1,8 @@
 package events
 
 import (
+	"time"
+
 	"github.com/nyaruka/chip/core/models"
 )
 
@@ -9,10 +11,13 @@ const TypeChatResumed string = "chat_resumed"
 type ChatResumed struct {
 	baseEvent
 
-	ChatID models.ChatID `json:"chat_id"`
-	Email  string        `json:"email"`
+	ChatID  models.ChatID `json:"chat_id"`
+	Email   string        `json:"email"`
+	Token   string        `json:"token"`
+	Online  bool          `json:"online"`
+	OpensOn *time.Time    `json:"opens_on,omitempty"`
 }
 
-func NewChatResumed(chatID models.ChatID, email string) *ChatResumed {
-	return &ChatResumed{baseEvent: baseEvent{Type_: TypeChatResumed}, ChatID: chatID, Email: email}
+func NewChatResumed(chatID models.ChatID, email, token string, availability *models.Availability) *ChatResumed {
+	return &ChatResumed{baseEvent: baseEvent{Type_: TypeChatResumed}, ChatID: chatID, Email: email, Token: token, Online: availability.Online, OpensOn: availability.OpensOn()}
 }
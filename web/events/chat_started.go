@@ -1,6 +1,8 @@
 package events
 
 import (
+	"time"
+
 	"github.com/nyaruka/chip/core/models"
 )
 
@@ -9,9 +11,12 @@ const TypeChatStarted string = "chat_started"
 type ChatStarted struct {
 	baseEvent
 
-	ChatID models.ChatID `json:"chat_id"`
+	ChatID  models.ChatID `json:"chat_id"`
+	Token   string        `json:"token"`
+	Online  bool          `json:"online"`
+	OpensOn *time.Time    `json:"opens_on,omitempty"`
 }
 
-func NewChatStarted(chatID models.ChatID) *ChatStarted {
-	return &ChatStarted{baseEvent: baseEvent{Type_: TypeChatStarted}, ChatID: chatID}
+func NewChatStarted(chatID models.ChatID, token string, availability *models.Availability) *ChatStarted {
+	return &ChatStarted{baseEvent: baseEvent{Type_: TypeChatStarted}, ChatID: chatID, Token: token, Online: availability.Online, OpensOn: availability.OpensOn()}
 }
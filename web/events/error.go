@@ -0,0 +1,30 @@
+package events
+
+const TypeError string = "error"
+
+// codes which clients can rely on to identify the type of error
+const (
+	ErrorCodeInvalidCommand     = "invalid_command"
+	ErrorCodeUnknownCommand     = "unknown_command"
+	ErrorCodeChatNotStarted     = "chat_not_started"
+	ErrorCodeChatAlreadyStarted = "chat_already_started"
+	ErrorCodeInvalidIdentity    = "invalid_identity"
+	ErrorCodeInvalidToken       = "invalid_token"
+	ErrorCodeInvalidAttachment  = "invalid_attachment"
+	ErrorCodeFieldNotAllowed    = "field_not_allowed"
+	ErrorCodeRateLimited        = "rate_limited"
+	ErrorCodeCommandInProgress  = "command_in_progress"
+	ErrorCodeServerError        = "server_error"
+)
+
+type Error struct {
+	baseEvent
+
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Command string `json:"command,omitempty"`
+}
+
+func NewError(code, message, command string) *Error {
+	return &Error{baseEvent: baseEvent{Type_: TypeError}, Code: code, Message: message, Command: command}
+}
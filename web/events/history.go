@@ -13,8 +13,10 @@ type HistoryEvent struct {
 	baseEvent
 
 	History []*HistoryItem `json:"history"`
+	HasMore bool           `json:"has_more"`
+	Cursor  string         `json:"cursor,omitempty"`
 }
 
-func NewHistory(history []*HistoryItem) *HistoryEvent {
-	return &HistoryEvent{baseEvent: baseEvent{Type_: TypeHistory}, History: history}
+func NewHistory(history []*HistoryItem, hasMore bool, cursor string) *HistoryEvent {
+	return &HistoryEvent{baseEvent: baseEvent{Type_: TypeHistory}, History: history, HasMore: hasMore, Cursor: cursor}
 }
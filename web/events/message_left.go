@@ -0,0 +1,22 @@
+package events
+
+import (
+	"time"
+
+	"github.com/nyaruka/chip/core/models"
+)
+
+const TypeMessageLeft string = "message_left"
+
+type MessageLeft struct {
+	baseEvent
+
+	ChatID models.ChatID `json:"chat_id"`
+	Token  string        `json:"token"`
+	MsgID  models.MsgID  `json:"msg_id"`
+	Time   time.Time     `json:"time"`
+}
+
+func NewMessageLeft(chatID models.ChatID, token string, msgID models.MsgID, createdOn time.Time) *MessageLeft {
+	return &MessageLeft{baseEvent: baseEvent{Type_: TypeMessageLeft}, ChatID: chatID, Token: token, MsgID: msgID, Time: createdOn}
+}
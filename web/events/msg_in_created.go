@@ -0,0 +1,20 @@
+package events
+
+import (
+	"time"
+
+	"github.com/nyaruka/chip/core/models"
+)
+
+const TypeMsgInCreated string = "msg_in_created"
+
+type MsgInCreated struct {
+	baseEvent
+
+	MsgID models.MsgID `json:"msg_id,omitempty"`
+	Time  time.Time    `json:"time"`
+}
+
+func NewMsgInCreated(msgID models.MsgID, createdOn time.Time) *MsgInCreated {
+	return &MsgInCreated{baseEvent: baseEvent{Type_: TypeMsgInCreated}, MsgID: msgID, Time: createdOn}
+}
@@ -0,0 +1,49 @@
+package events
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/gocommon/uuids"
+)
+
+const (
+	TypeTicketOpened   string = "ticket_opened"
+	TypeTicketClosed   string = "ticket_closed"
+	TypeTicketAssigned string = "ticket_assigned"
+)
+
+type TicketEvent struct {
+	baseEvent
+
+	EventUUID uuids.UUID   `json:"event_uuid"`
+	Assignee  *models.User `json:"assignee,omitempty"`
+	Time      time.Time    `json:"time"`
+}
+
+func NewTicketOpened(eventUUID uuids.UUID, t time.Time) *TicketEvent {
+	return &TicketEvent{baseEvent: baseEvent{Type_: TypeTicketOpened}, EventUUID: eventUUID, Time: t}
+}
+
+func NewTicketClosed(eventUUID uuids.UUID, t time.Time) *TicketEvent {
+	return &TicketEvent{baseEvent: baseEvent{Type_: TypeTicketClosed}, EventUUID: eventUUID, Time: t}
+}
+
+func NewTicketAssigned(eventUUID uuids.UUID, assignee *models.User, t time.Time) *TicketEvent {
+	return &TicketEvent{baseEvent: baseEvent{Type_: TypeTicketAssigned}, EventUUID: eventUUID, Assignee: assignee, Time: t}
+}
+
+// NewTicketEvent converts a chat event queued for a contact to the event sent to their clients
+func NewTicketEvent(e *models.ChatEvent) (*TicketEvent, error) {
+	switch e.Type {
+	case models.ChatEventTypeTicketOpened:
+		return NewTicketOpened(e.UUID, e.Time), nil
+	case models.ChatEventTypeTicketClosed:
+		return NewTicketClosed(e.UUID, e.Time), nil
+	case models.ChatEventTypeTicketAssigned:
+		return NewTicketAssigned(e.UUID, e.Assignee, e.Time), nil
+	default:
+		return nil, fmt.Errorf("unsupported event type: %s", e.Type)
+	}
+}
@@ -0,0 +1,15 @@
+package events
+
+import "github.com/nyaruka/chip/core/models"
+
+const TypeTyping string = "typing"
+
+type TypingEvent struct {
+	baseEvent
+
+	User *models.User `json:"user,omitempty"`
+}
+
+func NewTyping(user *models.User) *TypingEvent {
+	return &TypingEvent{baseEvent: baseEvent{Type_: TypeTyping}, User: user}
+}
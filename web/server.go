@@ -3,29 +3,57 @@ package web
 import (
 	"compress/flate"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/nyaruka/chip/core/dedupe"
 	"github.com/nyaruka/chip/core/models"
 	"github.com/nyaruka/chip/core/queue"
+	"github.com/nyaruka/chip/core/ratelimit"
+	"github.com/nyaruka/chip/core/sessions"
 	"github.com/nyaruka/chip/runtime"
+	"github.com/nyaruka/chip/web/events"
+	"github.com/nyaruka/gocommon/aws/cwatch"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/gocommon/uuids"
 	"golang.org/x/exp/maps"
 )
 
 type Service interface {
 	Store() models.Store
-	StartChat(context.Context, *models.Channel, models.ChatID) (*models.Contact, bool, error)
-	CreateMsgIn(context.Context, *models.Channel, *models.Contact, string) error
+	StartChat(context.Context, *models.Channel, models.ChatID, string, *models.Identity) (*models.Contact, bool, string, error)
+	ValidateSession(context.Context, *models.Channel, models.ChatID, string) error
+	SessionRevoked(context.Context, *models.Channel, models.ChatID) (bool, error)
+	RevokeSession(context.Context, *models.Channel, *models.Contact) error
+	StoreAttachment(context.Context, *models.Channel, *models.Contact, string, []byte) (string, error)
+	CreateMsgIn(context.Context, *models.Channel, *models.Contact, string, []string, models.MsgID) (*models.MsgIn, error)
+	LeaveMessage(context.Context, *models.Channel, models.ChatID, string, string, string, string) (*models.Contact, string, *models.MsgIn, error)
 	ConfirmDelivery(context.Context, *models.Channel, *models.Contact, queue.ItemID) error
+	ReportSendError(context.Context, *models.Channel, *models.Contact, queue.ItemID) error
+	MarkRead(context.Context, *models.Channel, *models.Contact, models.MsgID, time.Time) error
 	CloseChat(context.Context, *models.Channel, *models.Contact) error
 	QueueMsgOut(context.Context, *models.Channel, *models.Contact, *models.MsgOut) error
+	QueueEvent(context.Context, *models.Channel, *models.Contact, *models.ChatEvent) error
+	UpdateContact(context.Context, *models.Channel, *models.Contact, *models.ContactUpdate) error
+	ReportTyping(context.Context, *models.Channel, *models.Contact) error
+	NotifyTyping(context.Context, *models.Channel, *models.Contact, *models.User) error
+	NotifyMsgIn(context.Context, *models.Channel, *models.Contact, *models.MsgIn) error
 }
 
 type Server struct {
@@ -34,29 +62,83 @@ type Server struct {
 	httpServer *http.Server
 	wg         sync.WaitGroup
 
+	rejectedOrigins atomic.Int64
+	recentCommands  *dedupe.Commands
+	trustedProxies  []netip.Prefix
+	localLimits     *ratelimit.Local
+
 	clients     map[string]*Client
+	chats       map[chatKey][]*Client // clients with started chats, indexed by channel and chat ID
 	clientMutex *sync.RWMutex
+
+	sendErrors     chan *sendError
+	sendErrorsStop chan bool
+
+	availabilityStop chan bool
+	metricsStop      chan bool
+}
+
+// a message which couldn't be written to a client's socket
+type sendError struct {
+	client  *Client
+	contact *models.Contact
+	itemID  queue.ItemID
 }
 
+type chatKey struct {
+	channelUUID models.ChannelUUID
+	chatID      models.ChatID
+}
+
+// how often we check whether channels have opened or closed, which happens on the minute
+const availabilityInterval = 10 * time.Second
+
+// how often we send metrics to cloudwatch
+const metricsInterval = time.Minute
+
+// how long in seconds browsers can cache a channel's widget config, which matches how long the store caches channels
+const configMaxAge = 30
+
 func NewServer(rt *runtime.Runtime, service Service) *Server {
 	s := &Server{
 		rt:      rt,
 		service: service,
 
+		recentCommands: &dedupe.Commands{KeyBase: "chat", TTL: time.Hour},
+		trustedProxies: parseTrustedProxies(rt.Config.TrustedProxies),
+		localLimits:    ratelimit.NewLocal(),
+
 		clients:     make(map[string]*Client),
+		chats:       make(map[chatKey][]*Client),
 		clientMutex: &sync.RWMutex{},
+
+		sendErrors:     make(chan *sendError, 100),
+		sendErrorsStop: make(chan bool),
+
+		availabilityStop: make(chan bool),
+		metricsStop:      make(chan bool),
 	}
 
 	router := chi.NewRouter()
 	router.Use(middleware.Compress(flate.DefaultCompression))
 	router.Use(middleware.StripSlashes)
 	router.Use(middleware.RequestID)
-	router.Use(middleware.RealIP)
 	router.Use(middleware.Recoverer)
 	router.Use(middleware.Timeout(15 * time.Second))
 	router.Get("/", s.handleIndex)
 	router.Handle("/wc/connect/{channel:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", s.channelHandler(s.handleConnect))
+	router.Get("/wc/config/{channel:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", s.channelHandler(s.handleConfig))
 	router.Handle("/wc/send/{channel:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", s.channelHandler(s.handleSend))
+	router.Post("/wc/upload/{channel:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", s.channelHandler(s.handleUpload))
+	router.Options("/wc/upload/{channel:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", s.channelHandler(s.handlePreflight))
+	router.Handle("/wc/event/{channel:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", s.channelHandler(s.handleEvent))
+	router.Handle("/wc/typing/{channel:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", s.channelHandler(s.handleTyping))
+	router.Handle("/wc/revoke/{channel:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", s.channelHandler(s.handleRevoke))
+
+	// if we're storing attachments locally, we need to serve them too
+	if rt.Config.S3AttachmentsBucket == "" {
+		router.Handle("/wc/attachments/*", serveAttachments(http.StripPrefix("/wc/", http.FileServer(http.Dir(rt.Config.AttachmentsDir)))))
+	}
 
 	s.httpServer = &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", rt.Config.Address, rt.Config.Port),
@@ -69,7 +151,7 @@ func NewServer(rt *runtime.Runtime, service Service) *Server {
 func (s *Server) Start() {
 	log := s.log().With("address", s.rt.Config.Address, "port", s.rt.Config.Port)
 
-	s.wg.Add(1)
+	s.wg.Add(4)
 
 	go func() {
 		defer s.wg.Done()
@@ -80,6 +162,10 @@ func (s *Server) Start() {
 		}
 	}()
 
+	go s.sendErrorReporter()
+	go s.availabilityChecker()
+	go s.metricsReporter()
+
 	log.Info("started")
 }
 
@@ -99,6 +185,10 @@ func (s *Server) Stop() {
 		s.log().Error("error shutting down http server", "error", err)
 	}
 
+	close(s.sendErrorsStop)
+	close(s.availabilityStop)
+	close(s.metricsStop)
+
 	s.wg.Wait()
 
 	s.log().Info("stopped")
@@ -118,7 +208,148 @@ func (s *Server) channelHandler(fn func(context.Context, *http.Request, http.Res
 	}
 }
 
+// checks that a request from a browser comes from a site allowed to embed the widget for the given channel, writing an
+// error response if not and the CORS headers if so
+func (s *Server) checkOrigin(r *http.Request, w http.ResponseWriter, ch *models.Channel) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // not from a browser
+	}
+
+	if !isAllowedOrigin(origin, ch.AllowedOrigins(s.rt.Config)) {
+		s.rejectedOrigins.Add(1)
+
+		s.log().Warn("rejected request from disallowed origin", "channel", ch.UUID, "origin", origin, "path", r.URL.Path)
+
+		writeErrorResponse(w, http.StatusForbidden, "origin not allowed")
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+	return true
+}
+
+func isAllowedOrigin(origin string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+
+		// wildcard like https://*.example.com matches any subdomain of example.com
+		if scheme, domain, ok := strings.Cut(a, "://*."); ok {
+			if host, found := strings.CutPrefix(strings.ToLower(origin), strings.ToLower(scheme)+"://"); found && strings.HasSuffix(host, "."+strings.ToLower(domain)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handles a CORS preflight request from a browser
+func (s *Server) handlePreflight(ctx context.Context, r *http.Request, w http.ResponseWriter, ch *models.Channel) {
+	if !s.checkOrigin(r, w, ch) {
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checks whether an action by a client is within the socket, IP and channel rate limits of the given channel, taking a
+// token from each bucket if so
+func (s *Server) checkRateLimit(ch *models.Channel, action, ip, clientID string) bool {
+	log := s.log().With("channel", ch.UUID, "action", action, "ip", ip, "client_id", clientID)
+
+	scopes := []struct{ name, id string }{{"socket", clientID}, {"ip", ip}, {"channel", string(ch.UUID)}}
+	buckets := make([]*ratelimit.Bucket, 0, len(scopes))
+
+	for _, scope := range scopes {
+		if scope.id == "" {
+			continue // e.g. connects don't have a socket yet
+		}
+
+		limit, err := ratelimit.ParseLimit(ch.RateLimit(s.rt.Config, scope.name, action))
+		if err != nil {
+			log.Error("error parsing rate limit", "scope", scope.name, "error", err)
+			continue
+		}
+
+		buckets = append(buckets, &ratelimit.Bucket{Key: fmt.Sprintf("chat:ratelimit:%s:%s:%s", action, scope.name, scope.id), Limit: limit})
+	}
+
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	allowed, err := ratelimit.Take(rc, time.Now(), buckets...)
+	if err != nil {
+		log.Error("error checking rate limit, falling back to local limit", "error", err)
+
+		// rather than allow everything, use the most specific bucket, i.e. the socket, or the IP if there isn't one,
+		// held in memory by this instance
+		if len(buckets) > 0 {
+			allowed = s.localLimits.Take(time.Now(), buckets[0].Key, buckets[0].Limit)
+		} else {
+			allowed = true
+		}
+	}
+	if !allowed {
+		log.Warn("rate limit exceeded")
+	}
+
+	return allowed
+}
+
+// claims a command with an ID from a client so that it's only handled once, returning false and any recorded response
+// if it's a retry
+func (s *Server) claimCommand(ch *models.Channel, chatID models.ChatID, id string) (bool, []byte, error) {
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	return s.recentCommands.Claim(rc, ch, chatID, id)
+}
+
+// records the response to a claimed command so that it can be sent again if the command is retried
+func (s *Server) completeCommand(ch *models.Channel, chatID models.ChatID, id string, response events.Event) {
+	if id == "" {
+		return
+	}
+
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	if err := s.recentCommands.Complete(rc, ch, chatID, id, jsonx.MustMarshal(response)); err != nil {
+		s.log().Error("error completing command", "command_id", id, "error", err)
+	}
+}
+
+// releases a claimed command which failed so that the client can retry it
+func (s *Server) releaseCommand(ch *models.Channel, chatID models.ChatID, id string) {
+	if id == "" {
+		return
+	}
+
+	rc := s.rt.RP.Get()
+	defer rc.Close()
+
+	if err := s.recentCommands.Release(rc, ch, chatID, id); err != nil {
+		s.log().Error("error releasing command", "command_id", id, "error", err)
+	}
+}
+
 func (s *Server) handleConnect(ctx context.Context, r *http.Request, w http.ResponseWriter, ch *models.Channel) {
+	if !s.checkOrigin(r, w, ch) {
+		return
+	}
+
+	ip := s.remoteIP(r)
+
+	if !s.checkRateLimit(ch, "connect", ip, "") {
+		writeErrorResponse(w, http.StatusTooManyRequests, "too many requests")
+		return
+	}
+
 	// hijack the HTTP connection...
 	sock, err := httpx.NewWebSocket(w, r, 4096, 0)
 	if err != nil {
@@ -126,7 +357,7 @@ func (s *Server) handleConnect(ctx context.Context, r *http.Request, w http.Resp
 		return
 	}
 
-	client := NewClient(s, sock, ch)
+	client := NewClient(s, sock, ch, ip)
 
 	s.clientMutex.Lock()
 	s.clients[client.id] = client
@@ -137,15 +368,221 @@ func (s *Server) handleConnect(ctx context.Context, r *http.Request, w http.Resp
 	s.log().Info("client connected", "channel", ch.UUID, "client_id", client.id, "total", total)
 }
 
+// handles a request from the widget for its configuration, which browsers can cache and revalidate with the ETag
+func (s *Server) handleConfig(ctx context.Context, r *http.Request, w http.ResponseWriter, ch *models.Channel) {
+	if !s.checkOrigin(r, w, ch) {
+		return
+	}
+
+	body := jsonx.MustMarshal(ch.WidgetConfig(s.rt.Config))
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", configMaxAge))
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// gets the IP address of the client. Proxy headers are only used if the request came from a trusted proxy, and then
+// the client is the last address in X-Forwarded-For which wasn't added by another trusted proxy.
+func (s *Server) remoteIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	if !s.isTrustedProxy(ip) {
+		return ip
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		if _, err := netip.ParseAddr(realIP); err == nil {
+			return realIP
+		}
+		return ip
+	}
+
+	var forwarded []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(v, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if _, err := netip.ParseAddr(addr); err != nil {
+			break
+		}
+
+		ip = addr
+		if !s.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return ip
+}
+
+func (s *Server) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, p := range s.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parses a comma separated list of IP addresses and CIDR ranges, ignoring any which are invalid
+func parseTrustedProxies(s string) []netip.Prefix {
+	var prefixes []netip.Prefix
+
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+
+		if prefix, err := netip.ParsePrefix(p); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(p); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		} else {
+			slog.Error("invalid trusted proxy", "comp", "server", "proxy", p)
+		}
+	}
+	return prefixes
+}
+
+// handles an attachment upload from a client
+func (s *Server) handleUpload(ctx context.Context, r *http.Request, w http.ResponseWriter, ch *models.Channel) {
+	if !s.checkOrigin(r, w, ch) {
+		return
+	}
+
+	if !s.checkRateLimit(ch, "upload", s.remoteIP(r), "") {
+		writeErrorResponse(w, http.StatusTooManyRequests, "too many requests")
+		return
+	}
+
+	maxSize := ch.AttachmentMaxSize(s.rt.Config)
+
+	// allow some extra for the other parts of the multipart body
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxSize)+4096)
+
+	if err := r.ParseMultipartForm(int64(maxSize)); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("error reading request: %s", err))
+		return
+	}
+
+	// the chat ID alone isn't proof of who the client is, so also require the session token
+	chatID := models.ChatID(r.FormValue("chat_id"))
+	if err := s.service.ValidateSession(ctx, ch, chatID, r.FormValue("token")); errors.Is(err, sessions.ErrInvalidToken) {
+		writeErrorResponse(w, http.StatusForbidden, "invalid session token")
+		return
+	} else if err != nil {
+		s.log().Error("error validating session for upload", "error", err)
+
+		writeErrorResponse(w, http.StatusInternalServerError, "unable to validate session")
+		return
+	}
+
+	contact, err := models.LoadContact(ctx, s.rt, ch.OrgID, chatID)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("error loading contact with chat id %s: %s", chatID, err))
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("error reading file: %s", err))
+		return
+	}
+	defer file.Close()
+
+	if header.Size > int64(maxSize) {
+		writeErrorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("file exceeds maximum size of %d bytes", maxSize))
+		return
+	}
+
+	body, err := io.ReadAll(file)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("error reading file: %s", err))
+		return
+	}
+
+	// don't trust the content type provided by the client
+	contentType, _, _ := strings.Cut(mimetype.Detect(body).String(), ";")
+
+	if !isAllowedType(contentType, ch.AttachmentTypes(s.rt.Config)) {
+		writeErrorResponse(w, http.StatusUnsupportedMediaType, fmt.Sprintf("file type %s not allowed", contentType))
+		return
+	}
+
+	url, err := s.service.StoreAttachment(ctx, ch, contact, contentType, body)
+	if err != nil {
+		s.log().Error("error handling upload request", "error", err)
+
+		writeErrorResponse(w, http.StatusInternalServerError, "unable to store attachment")
+		return
+	}
+
+	writeMarshalled(w, http.StatusOK, map[string]any{"url": url})
+}
+
+// content types which browsers can execute scripts in, and so are never matched by wildcards like image/*
+var scriptableTypes = []string{
+	"image/svg+xml",
+	"text/html",
+	"application/xhtml+xml",
+	"text/xml",
+	"application/xml",
+	"text/javascript",
+	"application/javascript",
+}
+
+// checks whether the given content type matches one of the allowed types, which may be wildcards like image/*
+func isAllowedType(contentType string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == contentType {
+			return true
+		}
+		if strings.HasSuffix(a, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(a, "*")) && !slices.Contains(scriptableTypes, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// wraps a handler for serving uploaded attachments so that browsers download rather than render them
+func serveAttachments(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", "attachment")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		h.ServeHTTP(w, r)
+	})
+}
+
 type sendRequest struct {
 	ChatID models.ChatID `json:"chat_id"              validate:"required"`
 	Secret string        `json:"secret"               validate:"required"`
 	Msg    struct {
-		ID          models.MsgID     `json:"id"       validate:"required"`
-		Text        string           `json:"text"`
-		Attachments []string         `json:"attachments"`
-		Origin      models.MsgOrigin `json:"origin"   validate:"required"`
-		UserID      models.UserID    `json:"user_id"`
+		ID           models.MsgID     `json:"id"       validate:"required"`
+		Text         string           `json:"text"`
+		Attachments  []string         `json:"attachments"`
+		QuickReplies []string         `json:"quick_replies"`
+		Locale       string           `json:"locale"`
+		Origin       models.MsgOrigin `json:"origin"   validate:"required"`
+		UserID       models.UserID    `json:"user_id"`
 	} `json:"msg"`
 }
 
@@ -177,7 +614,11 @@ func (s *Server) handleSend(ctx context.Context, r *http.Request, w http.Respons
 		}
 	}
 
-	err = s.service.QueueMsgOut(ctx, ch, contact, models.NewMsgOut(payload.Msg.ID, payload.Msg.Text, payload.Msg.Attachments, payload.Msg.Origin, user, time.Now()))
+	msg := models.NewMsgOut(payload.Msg.ID, payload.Msg.Text, payload.Msg.Attachments, payload.Msg.Origin, user, time.Now())
+	msg.QuickReplies = payload.Msg.QuickReplies
+	msg.Locale = payload.Msg.Locale
+
+	err = s.service.QueueMsgOut(ctx, ch, contact, msg)
 	if err == nil {
 		writeMarshalled(w, http.StatusOK, map[string]any{"status": "queued"})
 	} else {
@@ -188,32 +629,292 @@ func (s *Server) handleSend(ctx context.Context, r *http.Request, w http.Respons
 	}
 }
 
+type eventRequest struct {
+	ChatID models.ChatID `json:"chat_id"                validate:"required"`
+	Secret string        `json:"secret"                 validate:"required"`
+	Event  struct {
+		UUID       uuids.UUID           `json:"uuid"        validate:"required"`
+		Type       models.ChatEventType `json:"type"        validate:"required"`
+		AssigneeID models.UserID        `json:"assignee_id"`
+	} `json:"event"`
+}
+
+// handles a request from courier to send a non-message event, e.g. a ticket being closed, to a contact
+func (s *Server) handleEvent(ctx context.Context, r *http.Request, w http.ResponseWriter, ch *models.Channel) {
+	payload := &eventRequest{}
+	if err := jsonx.UnmarshalWithLimit(r.Body, payload, 1024*1024); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("error reading request: %s", err))
+		return
+	}
+
+	if ch.Secret() != payload.Secret {
+		writeErrorResponse(w, http.StatusBadRequest, "channel secret incorrect")
+		return
+	}
+
+	// check the event is one we can send to clients before queuing it
+	if _, err := events.NewTicketEvent(models.NewChatEvent(payload.Event.UUID, payload.Event.Type, nil, time.Now())); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	contact, err := models.LoadContact(ctx, s.rt, ch.OrgID, payload.ChatID)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("error loading contact with chat id %s: %s", payload.ChatID, err))
+		return
+	}
+
+	var assignee *models.User
+	if payload.Event.AssigneeID != models.NilUserID {
+		assignee, err = s.service.Store().GetUser(ctx, payload.Event.AssigneeID)
+		if err != nil {
+			writeErrorResponse(w, http.StatusNotFound, "user not found")
+			return
+		}
+	}
+
+	e := models.NewChatEvent(payload.Event.UUID, payload.Event.Type, assignee, time.Now())
+
+	if err := s.service.QueueEvent(ctx, ch, contact, e); err != nil {
+		s.log().Error("error handing event request", "error", err)
+
+		writeErrorResponse(w, http.StatusInternalServerError, "unable to queue event")
+		return
+	}
+
+	writeMarshalled(w, http.StatusOK, map[string]any{"status": "queued"})
+}
+
+type typingRequest struct {
+	ChatID models.ChatID `json:"chat_id" validate:"required"`
+	Secret string        `json:"secret"  validate:"required"`
+	UserID models.UserID `json:"user_id"`
+}
+
+// handles a request from courier to notify a contact that a user is typing
+func (s *Server) handleTyping(ctx context.Context, r *http.Request, w http.ResponseWriter, ch *models.Channel) {
+	payload := &typingRequest{}
+	if err := jsonx.UnmarshalWithLimit(r.Body, payload, 1024*1024); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("error reading request: %s", err))
+		return
+	}
+
+	if ch.Secret() != payload.Secret {
+		writeErrorResponse(w, http.StatusBadRequest, "channel secret incorrect")
+		return
+	}
+
+	contact, err := models.LoadContact(ctx, s.rt, ch.OrgID, payload.ChatID)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("error loading contact with chat id %s: %s", payload.ChatID, err))
+		return
+	}
+
+	var user *models.User
+	if payload.UserID != models.NilUserID {
+		user, err = s.service.Store().GetUser(ctx, payload.UserID)
+		if err != nil {
+			writeErrorResponse(w, http.StatusNotFound, "user not found")
+			return
+		}
+	}
+
+	if err := s.service.NotifyTyping(ctx, ch, contact, user); err != nil {
+		s.log().Error("error handing typing request", "error", err)
+
+		writeErrorResponse(w, http.StatusInternalServerError, "unable to notify typing")
+		return
+	}
+
+	writeMarshalled(w, http.StatusOK, map[string]any{"status": "notified"})
+}
+
+type revokeRequest struct {
+	ChatID models.ChatID `json:"chat_id" validate:"required"`
+	Secret string        `json:"secret"  validate:"required"`
+}
+
+// handles a request to revoke the session token of a chat so that it can no longer be resumed
+func (s *Server) handleRevoke(ctx context.Context, r *http.Request, w http.ResponseWriter, ch *models.Channel) {
+	payload := &revokeRequest{}
+	if err := jsonx.UnmarshalWithLimit(r.Body, payload, 1024*1024); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("error reading request: %s", err))
+		return
+	}
+
+	if ch.Secret() != payload.Secret {
+		writeErrorResponse(w, http.StatusBadRequest, "channel secret incorrect")
+		return
+	}
+
+	contact, err := models.LoadContact(ctx, s.rt, ch.OrgID, payload.ChatID)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("error loading contact with chat id %s: %s", payload.ChatID, err))
+		return
+	}
+
+	if err := s.service.RevokeSession(ctx, ch, contact); err != nil {
+		s.log().Error("error handing revoke request", "error", err)
+
+		writeErrorResponse(w, http.StatusInternalServerError, "unable to revoke session")
+		return
+	}
+
+	writeMarshalled(w, http.StatusOK, map[string]any{"status": "revoked"})
+}
+
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	writeMarshalled(w, http.StatusOK, map[string]string{"version": s.rt.Config.Version})
 }
 
-func (s *Server) GetClient(chatID models.ChatID) *Client {
+// queues a message which couldn't be sent to a client to be reported to courier, without blocking that client
+func (s *Server) queueSendError(c *Client, contact *models.Contact, itemID queue.ItemID) {
+	select {
+	case s.sendErrors <- &sendError{client: c, contact: contact, itemID: itemID}:
+	default:
+		s.log().Error("send error queue full, not reporting", "chat_id", contact.ChatID, "item_id", itemID)
+	}
+}
+
+func (s *Server) sendErrorReporter() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case e := <-s.sendErrors:
+			s.reportSendError(e)
+		case <-s.sendErrorsStop:
+			return
+		}
+	}
+}
+
+// reports a message which couldn't be sent to a client as errored, unless another client for the same chat is still
+// connected to this instance, in which case it can still be delivered
+func (s *Server) reportSendError(e *sendError) {
+	others := slices.DeleteFunc(s.GetClients(e.client.channel.UUID, e.contact.ChatID), func(o *Client) bool { return o == e.client })
+	if len(others) > 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := s.service.ReportSendError(ctx, e.client.channel, e.contact, e.itemID); err != nil {
+		s.log().Error("error reporting send error", "chat_id", e.contact.ChatID, "item_id", e.itemID, "error", err)
+	}
+}
+
+// GetClients returns the clients connected to this instance for the given chat, e.g. a contact with multiple tabs open
+func (s *Server) GetClients(channelUUID models.ChannelUUID, chatID models.ChatID) []*Client {
 	defer s.clientMutex.RUnlock()
 
 	s.clientMutex.RLock()
 
-	// TODO maintain map by contact ?
-	for _, c := range s.clients {
-		if c.chatID() == chatID {
-			return c
+	return slices.Clone(s.chats[chatKey{channelUUID, chatID}])
+}
+
+func (s *Server) availabilityChecker() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(availabilityInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.CheckAvailability(now)
+		case <-s.availabilityStop:
+			return
+		}
+	}
+}
+
+func (s *Server) metricsReporter() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(metricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportMetrics()
+		case <-s.metricsStop:
+			return
+		}
+	}
+}
+
+// sends the counts of things that have happened since the last report to cloudwatch
+func (s *Server) reportMetrics() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rejectedOrigins := s.rejectedOrigins.Swap(0)
+
+	if err := s.rt.CW.Send(ctx, cwatch.Datum("RejectedOrigins", float64(rejectedOrigins), types.StandardUnitCount)); err != nil {
+		s.log().Error("error sending metrics", "error", err)
+	}
+}
+
+// CheckAvailability lets connected clients know if their channel has gone online or offline. Channels are re-fetched
+// from the store so that changes to their schedules reach clients which are already connected.
+func (s *Server) CheckAvailability(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s.clientMutex.RLock()
+	clients := maps.Values(s.clients)
+	s.clientMutex.RUnlock()
+
+	channels := make(map[models.ChannelUUID]*models.Channel)
+
+	for _, c := range clients {
+		ch, fetched := channels[c.channel.UUID]
+		if !fetched {
+			var err error
+			if ch, err = s.service.Store().GetChannel(ctx, c.channel.UUID); err != nil {
+				s.log().Error("error fetching channel", "channel", c.channel.UUID, "error", err)
+				ch = c.channel // use the channel as it was when the client connected
+			}
+			channels[c.channel.UUID] = ch
 		}
+
+		c.checkAvailability(ch, now)
 	}
-	return nil
 }
 
-func (s *Server) OnDisconnect(c *Client) {
+// OnChatStarted is called when a client has successfully started a chat
+func (s *Server) OnChatStarted(c *Client) {
+	key := chatKey{c.channel.UUID, c.chatID()}
+
+	s.clientMutex.Lock()
+	s.chats[key] = append(s.chats[key], c)
+	s.clientMutex.Unlock()
+}
+
+// OnDisconnect is called when a client disconnects and returns whether it was the last client for its chat
+func (s *Server) OnDisconnect(c *Client) bool {
+	key := chatKey{c.channel.UUID, c.chatID()}
+
 	s.clientMutex.Lock()
 	delete(s.clients, c.id)
+
+	others := slices.DeleteFunc(s.chats[key], func(o *Client) bool { return o == c })
+	if len(others) > 0 {
+		s.chats[key] = others
+	} else {
+		delete(s.chats, key)
+	}
+
 	total := len(s.clients)
 	s.clientMutex.Unlock()
 	s.wg.Done()
 
 	s.log().Info("client disconnected", "total", total)
+
+	return len(others) == 0
 }
 
 func (s *Server) log() *slog.Logger {
@@ -1,16 +1,27 @@
 package web_test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/nyaruka/chip"
 	"github.com/nyaruka/chip/core/models"
+	"github.com/nyaruka/chip/core/pubsub"
+	"github.com/nyaruka/chip/core/queue"
+	"github.com/nyaruka/chip/core/sessions"
 	"github.com/nyaruka/chip/testsuite"
 	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/random"
+	"github.com/nyaruka/vkutil/assertvk"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -20,6 +31,7 @@ func TestServer(t *testing.T) {
 
 	defer testsuite.ResetDB()
 	defer testsuite.ResetValkey()
+	defer testsuite.ResetStorage()
 
 	defer random.SetGenerator(random.DefaultGenerator)
 	random.SetGenerator(random.NewSeededGenerator(1234))
@@ -29,7 +41,7 @@ func TestServer(t *testing.T) {
 
 	mockCourier := testsuite.NewMockCourier(rt)
 
-	svc := chip.NewService(rt, mockCourier)
+	svc := chip.NewService(rt, mockCourier, testsuite.NewMockMailer(), testsuite.Attachments(rt))
 	assert.NoError(t, svc.Start())
 
 	defer svc.Stop()
@@ -43,7 +55,7 @@ func TestServer(t *testing.T) {
 	assert.Equal(t, `{"version":"Dev"}`, string(trace.ResponseBody))
 
 	orgID := testsuite.InsertOrg(rt, "Nyaruka")
-	testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame"})
+	chID := testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame"})
 	ch, err := models.LoadChannel(ctx, rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9")
 	require.NoError(t, err)
 
@@ -61,8 +73,89 @@ func TestServer(t *testing.T) {
 	assert.Equal(t, 400, trace.Response.StatusCode)
 	assert.Equal(t, "Bad Request\n", string(trace.ResponseBody))
 
+	// create a channel which can only be embedded on certain sites
+	testsuite.InsertChannel(rt, "3a9b0b9e-4b0d-4fa6-9e2c-d0d9eb2c7c3a", orgID, "CHP", "WebChat", "456", []string{"webchat"}, map[string]any{"secret": "sesame", "allowed_origins": []string{"https://example.com", "https://*.example.org"}})
+
+	// try to connect from a site which isn't allowed
+	req, _ = http.NewRequest("POST", "http://localhost:8071/wc/connect/3a9b0b9e-4b0d-4fa6-9e2c-d0d9eb2c7c3a/", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, trace.Response.StatusCode)
+	assert.Equal(t, `{"error":"origin not allowed"}`, string(trace.ResponseBody))
+
+	// browsers will make a preflight request before uploading
+	for origin, allowed := range map[string]bool{
+		"https://example.com":             true,
+		"https://app.example.org":         true,
+		"https://example.org.evil.com":    false,
+		"http://app.example.org":          false,
+		"https://evil.com/?https://x.com": false,
+	} {
+		req, _ = http.NewRequest("OPTIONS", "http://localhost:8071/wc/upload/3a9b0b9e-4b0d-4fa6-9e2c-d0d9eb2c7c3a/", nil)
+		req.Header.Set("Origin", origin)
+		trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+		assert.NoError(t, err)
+
+		if allowed {
+			assert.Equal(t, 204, trace.Response.StatusCode, "status mismatch for origin %s", origin)
+			assert.Equal(t, origin, trace.Response.Header.Get("Access-Control-Allow-Origin"))
+			assert.Equal(t, "POST", trace.Response.Header.Get("Access-Control-Allow-Methods"))
+		} else {
+			assert.Equal(t, 403, trace.Response.StatusCode, "status mismatch for origin %s", origin)
+			assert.Equal(t, "", trace.Response.Header.Get("Access-Control-Allow-Origin"))
+		}
+	}
+
+	// the default for channels without allowed origins is to allow any site
+	req, _ = http.NewRequest("OPTIONS", "http://localhost:8071/wc/upload/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, trace.Response.StatusCode)
+	assert.Equal(t, "https://evil.com", trace.Response.Header.Get("Access-Control-Allow-Origin"))
+
+	// widget fetches its config, which doesn't include the channel secret
+	req, _ = http.NewRequest("GET", "http://localhost:8071/wc/config/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", nil)
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, trace.Response.StatusCode)
+	assert.Equal(t, `{"attachment_types":["image/*","audio/*","video/*","application/pdf"],"attachment_max_size":10485760}`, string(trace.ResponseBody))
+	assert.Equal(t, "public, max-age=30", trace.Response.Header.Get("Cache-Control"))
+
+	etag := trace.Response.Header.Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{64}"$`, etag)
+
+	// and can revalidate it using the ETag
+	req, _ = http.NewRequest("GET", "http://localhost:8071/wc/config/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", nil)
+	req.Header.Set("If-None-Match", etag)
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 304, trace.Response.StatusCode)
+	assert.Equal(t, "", string(trace.ResponseBody))
+
+	// try to fetch config from a site which isn't allowed
+	req, _ = http.NewRequest("GET", "http://localhost:8071/wc/config/3a9b0b9e-4b0d-4fa6-9e2c-d0d9eb2c7c3a/", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, trace.Response.StatusCode)
+
 	client := testsuite.NewClient(t, "ws://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/")
 
+	// invalid commands are rejected with an error event
+	client.Send(t, `{"type": "dance"}`)
+	assert.JSONEq(t, `{"type": "error", "code": "unknown_command", "message": "unknown command type 'dance'", "command": "dance"}`, client.Read(t))
+
+	client.Send(t, `{"type": "send_msg"}`)
+	assert.JSONEq(t, `{"type": "error", "code": "invalid_command", "message": "Key: 'SendMsg.Text' Error:Field validation for 'Text' failed on the 'required_without' tag", "command": "send_msg"}`, client.Read(t))
+
+	client.Send(t, `{"type": "send_msg", "text": "hello"}`)
+	assert.JSONEq(t, `{"type": "error", "code": "chat_not_started", "message": "chat not started", "command": "send_msg"}`, client.Read(t))
+
+	client.Send(t, `{"type": "start_chat", "identity": "xyz"}`)
+	assert.JSONEq(t, `{"type": "error", "code": "invalid_identity", "message": "invalid identity: channel has no identity key", "command": "start_chat"}`, client.Read(t))
+
 	client.Send(t, `{"type": "start_chat"}`)
 
 	contact, err := models.LoadContact(ctx, rt, orgID, "itlu4O6ZE4ZZc07Y5rHxcLoQ")
@@ -71,16 +164,43 @@ func TestServer(t *testing.T) {
 
 	assert.Equal(t, []string{"StartChat(8291264a-4581-4d12-96e5-e9fcfa6e68d9, itlu4O6ZE4ZZc07Y5rHxcLoQ)"}, mockCourier.Calls)
 
-	// server should send a chat_started event back to the client
-	assert.JSONEq(t, `{"type":"chat_started","chat_id":"itlu4O6ZE4ZZc07Y5rHxcLoQ"}`, client.Read(t))
+	// server should send a chat_started event back to the client with a session token
+	event, token := readWithToken(t, client)
+	assert.JSONEq(t, fmt.Sprintf(`{"type":"chat_started","chat_id":"itlu4O6ZE4ZZc07Y5rHxcLoQ","token":"%s","online":true}`, token), event)
 
-	client.Send(t, `{"type": "send_msg", "text": "hello"}`)
+	client.Send(t, `{"type": "start_chat"}`)
+	assert.JSONEq(t, `{"type": "error", "code": "chat_already_started", "message": "chat already started", "command": "start_chat"}`, client.Read(t))
+
+	client.Send(t, `{"type": "send_msg", "id": "c1", "text": "hello"}`)
 
 	assert.Equal(t, []string{
 		"StartChat(8291264a-4581-4d12-96e5-e9fcfa6e68d9, itlu4O6ZE4ZZc07Y5rHxcLoQ)",
-		"CreateMsg(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, 'hello')",
+		"CreateMsg(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, 'hello', [])",
 	}, mockCourier.Calls)
 
+	// server should confirm the message was created, including the command ID
+	assert.JSONEq(t, `{"type":"msg_in_created","command_id":"c1","msg_id":1,"time":"2024-05-02T16:05:10Z"}`, client.Read(t))
+
+	// and send it back as a chat_in event with the ID and time assigned by courier
+	assert.JSONEq(t, `{"type":"chat_in","msg_in":{"id":1,"text":"hello","time":"2024-05-02T16:05:10Z"}}`, client.Read(t))
+
+	// if client retries the command, message isn't created again but client gets the same response
+	client.Send(t, `{"type": "send_msg", "id": "c1", "text": "hello"}`)
+
+	assert.Len(t, mockCourier.Calls, 2)
+	assert.JSONEq(t, `{"type":"msg_in_created","command_id":"c1","msg_id":1,"time":"2024-05-02T16:05:10Z"}`, client.Read(t))
+
+	// if client retries a command that's still being handled, it's told to wait for the response
+	vc := rt.RP.Get()
+	_, err = vc.Do("SET", "chat:command:itlu4O6ZE4ZZc07Y5rHxcLoQ@8291264a-4581-4d12-96e5-e9fcfa6e68d9:c2", "")
+	vc.Close()
+	require.NoError(t, err)
+
+	client.Send(t, `{"type": "send_msg", "id": "c2", "text": "hello again"}`)
+
+	assert.Len(t, mockCourier.Calls, 2)
+	assert.JSONEq(t, `{"type": "error", "code": "command_in_progress", "message": "command is still being handled", "command": "send_msg", "command_id": "c2"}`, client.Read(t))
+
 	client.Send(t, `{"type": "set_email", "email": "bob@nyaruka.com"}`)
 
 	// reload contact and check email is now set
@@ -88,15 +208,24 @@ func TestServer(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "bob@nyaruka.com", contact.Email)
 
-	client.Send(t, `{"type": "get_history", "before": "2024-05-02T16:05:12Z"}`)
+	// history can be read by the client which started the chat
+	client.Send(t, `{"type": "get_history", "id": "c2"}`)
 
-	// server should send a history event back to the client
-	assert.JSONEq(t, `{
+	// server should send a history event back to the client with a cursor for the next page
+	helloCursor := (&models.MsgCursor{Time: time.Date(2024, 5, 2, 16, 5, 10, 0, time.UTC), ID: 1}).String()
+
+	assert.JSONEq(t, fmt.Sprintf(`{
 		"type": "history",
+		"command_id": "c2",
 		"history": [
-			{"msg_in": {"id":1, "text": "hello", "time": "2024-05-02T16:05:10Z"}}
-		]
-	}`, client.Read(t))
+			{"msg_in": {"id":1, "text": "hello", "time": "2024-05-02T16:05:10Z", "status": "handled"}}
+		],
+		"has_more": false,
+		"cursor": "%s"
+	}`, helloCursor), client.Read(t))
+
+	client.Send(t, `{"type": "get_history", "before": "xyz"}`)
+	assert.JSONEq(t, `{"type": "error", "code": "invalid_command", "message": "invalid cursor", "command": "get_history"}`, client.Read(t))
 
 	// queue a message to be sent to the client
 	err = svc.QueueMsgOut(ctx, ch, contact, models.NewMsgOut(123, "welcome", nil, models.MsgOriginBroadcast, nil, dates.Now()))
@@ -108,8 +237,575 @@ func TestServer(t *testing.T) {
 	// client acknowledges receipt of the message
 	client.Send(t, `{"type": "ack_chat", "msg_id": 123}`)
 
-	assert.Equal(t, "ReportDelivered(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, 123)", mockCourier.Calls[2])
+	assert.Equal(t, "ReportStatus(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, [123], delivered)", mockCourier.Calls[2])
+
+	// client marks all messages up to a time as read
+	msgID := testsuite.InsertOutgoingMsg(rt, orgID, chID, contact.ID, contact.URNID, "how can I help?", time.Date(2024, 5, 2, 16, 5, 30, 0, time.UTC))
+	_, err = rt.DB.Exec(`UPDATE msgs_msg SET status = 'W' WHERE id = $1`, msgID)
+	require.NoError(t, err)
+
+	client.Send(t, `{"type": "mark_read", "time": "2024-05-02T16:06:00Z"}`)
+
+	assert.Equal(t, fmt.Sprintf("ReportStatus(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, [%d], read)", msgID), mockCourier.Calls[3])
+
+	// and history now includes read status for that message, and when that status last changed
+	var modifiedOn time.Time
+	require.NoError(t, rt.DB.QueryRow(`SELECT modified_on FROM msgs_msg WHERE id = $1`, msgID).Scan(&modifiedOn))
+
+	client.Send(t, `{"type": "get_history", "limit": 1}`)
+
+	msgCursor := (&models.MsgCursor{Time: time.Date(2024, 5, 2, 16, 5, 30, 0, time.UTC), ID: msgID}).String()
+
+	assert.JSONEq(t, fmt.Sprintf(`{
+		"type": "history",
+		"history": [
+			{"msg_out": {"id":%d, "text": "how can I help?", "origin": "chat", "time": "2024-05-02T16:05:30Z", "status": "read", "modified_on": %s}}
+		],
+		"has_more": true,
+		"cursor": "%s"
+	}`, msgID, jsonx.MustMarshal(modifiedOn), msgCursor), client.Read(t))
+
+	// fetch the next page of older messages
+	client.Send(t, fmt.Sprintf(`{"type": "get_history", "before": "%s", "limit": 1}`, msgCursor))
+
+	assert.JSONEq(t, fmt.Sprintf(`{
+		"type": "history",
+		"history": [
+			{"msg_in": {"id":1, "text": "hello", "time": "2024-05-02T16:05:10Z", "status": "handled"}}
+		],
+		"has_more": false,
+		"cursor": "%s"
+	}`, helloCursor), client.Read(t))
+
+	// or catch up on newer messages after reconnecting
+	client.Send(t, fmt.Sprintf(`{"type": "get_history", "after": "%s"}`, helloCursor))
+
+	assert.JSONEq(t, fmt.Sprintf(`{
+		"type": "history",
+		"history": [
+			{"msg_out": {"id":%d, "text": "how can I help?", "origin": "chat", "time": "2024-05-02T16:05:30Z", "status": "read", "modified_on": %s}}
+		],
+		"has_more": false,
+		"cursor": "%s"
+	}`, msgID, jsonx.MustMarshal(modifiedOn), msgCursor), client.Read(t))
+
+	// client lets us know the contact is typing
+	client.Send(t, `{"type": "typing"}`)
+
+	assert.Equal(t, "ReportTyping(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1)", mockCourier.Calls[4])
+
+	// courier lets us know a user is typing
+	leahID := testsuite.InsertUser(rt, "leah@nyaruka.com", "Leah", "Tickets", "")
+
+	req, _ = http.NewRequest("POST", "http://localhost:8071/wc/typing/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", strings.NewReader(fmt.Sprintf(`{"chat_id": "itlu4O6ZE4ZZc07Y5rHxcLoQ", "secret": "sesame", "user_id": %d}`, leahID)))
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, trace.Response.StatusCode)
+	assert.Equal(t, `{"status":"notified"}`, string(trace.ResponseBody))
+
+	assert.JSONEq(t, fmt.Sprintf(`{"type": "typing", "user": {"id": %d, "email": "leah@nyaruka.com", "name": "Leah Tickets"}}`, leahID), client.Read(t))
+
+	// try with incorrect secret
+	req, _ = http.NewRequest("POST", "http://localhost:8071/wc/typing/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", strings.NewReader(`{"chat_id": "itlu4O6ZE4ZZc07Y5rHxcLoQ", "secret": "xyz"}`))
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, trace.Response.StatusCode)
+	assert.Equal(t, `{"error":"channel secret incorrect"}`, string(trace.ResponseBody))
+
+	// try to upload an image without a session token or with the wrong one
+	for _, tok := range []string{"", "1714669504.xyz.abc"} {
+		trace = uploadFile(t, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", "itlu4O6ZE4ZZc07Y5rHxcLoQ", tok, "screenshot.png", []byte("\x89PNG\r\n\x1a\n..."))
+		assert.Equal(t, 403, trace.Response.StatusCode)
+		assert.Equal(t, `{"error":"invalid session token"}`, string(trace.ResponseBody))
+	}
+
+	// client uploads an image
+	trace = uploadFile(t, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", "itlu4O6ZE4ZZc07Y5rHxcLoQ", token, "screenshot.png", []byte("\x89PNG\r\n\x1a\n..."))
+	assert.Equal(t, 200, trace.Response.StatusCode)
+
+	upload := &struct {
+		URL string `json:"url"`
+	}{}
+	jsonx.MustUnmarshal(trace.ResponseBody, upload)
+	assert.Regexp(t, `^http://localhost:8071/wc/attachments/8291264a-4581-4d12-96e5-e9fcfa6e68d9/1/[0-9a-f\-]{36}\.png$`, upload.URL)
+
+	// which we can fetch since we're using local storage
+	req, _ = http.NewRequest("GET", upload.URL, nil)
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, trace.Response.StatusCode)
+	assert.Equal(t, "\x89PNG\r\n\x1a\n...", string(trace.ResponseBody))
+	assert.Equal(t, "attachment", trace.Response.Header.Get("Content-Disposition"))
+	assert.Equal(t, "nosniff", trace.Response.Header.Get("X-Content-Type-Options"))
+
+	// and then send in a message
+	client.Send(t, fmt.Sprintf(`{"type": "send_msg", "attachments": ["%s"]}`, upload.URL))
+
+	assert.Equal(t, fmt.Sprintf("CreateMsg(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, '', [%s])", upload.URL), mockCourier.Calls[5])
+	assert.Regexp(t, `^{"type":"msg_in_created","msg_id":\d+,"time":"[^"]+"}$`, client.Read(t))
+	assert.Regexp(t, `^{"type":"chat_in","msg_in":{"id":\d+,"text":"","attachments":\["[^"]+"\],"time":"[^"]+"}}$`, client.Read(t))
+
+	// try to send an attachment that wasn't uploaded by this contact
+	client.Send(t, `{"type": "send_msg", "attachments": ["http://localhost:8071/wc/attachments/8291264a-4581-4d12-96e5-e9fcfa6e68d9/2/1234.png"]}`)
+	assert.Len(t, mockCourier.Calls, 6)
+	assert.JSONEq(t, `{"type": "error", "code": "invalid_attachment", "message": "attachment not uploaded by contact", "command": "send_msg"}`, client.Read(t))
+
+	// courier sends a message with quick replies
+	qrMsgID := testsuite.InsertOutgoingMsg(rt, orgID, chID, contact.ID, contact.URNID, "Are you happy?", time.Date(2024, 5, 2, 16, 7, 0, 0, time.UTC))
+	req, _ = http.NewRequest("POST", "http://localhost:8071/wc/send/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", strings.NewReader(fmt.Sprintf(`{"chat_id": "itlu4O6ZE4ZZc07Y5rHxcLoQ", "secret": "sesame", "msg": {"id": %d, "text": "Are you happy?", "quick_replies": ["Yes", "No"], "locale": "eng-US", "origin": "flow"}}`, qrMsgID)))
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, trace.Response.StatusCode)
+	assert.Equal(t, `{"status":"queued"}`, string(trace.ResponseBody))
+
+	assert.Regexp(t, fmt.Sprintf(`^{"type":"chat_out","msg_out":{"id":%d,"text":"Are you happy\?","quick_replies":\["Yes","No"\],"locale":"eng-US","origin":"flow","time":"[^"]+"}}$`, qrMsgID), client.Read(t))
+
+	client.Send(t, fmt.Sprintf(`{"type": "ack_chat", "msg_id": %d}`, qrMsgID))
+
+	// client taps a quick reply which is sent as a reply to that message
+	client.Send(t, fmt.Sprintf(`{"type": "send_msg", "text": "Yes", "reply_to": %d}`, qrMsgID))
+
+	assert.Equal(t, fmt.Sprintf("CreateMsg(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, 'Yes', [], %d)", qrMsgID), mockCourier.Calls[7])
+	assert.Regexp(t, `^{"type":"msg_in_created","msg_id":\d+,"time":"[^"]+"}$`, client.Read(t))
+	assert.Regexp(t, fmt.Sprintf(`^{"type":"chat_in","msg_in":{"id":\d+,"text":"Yes","time":"[^"]+","reply_to":%d}}$`, qrMsgID), client.Read(t))
+
+	// client can't reply to a message that wasn't sent to them
+	client.Send(t, `{"type": "send_msg", "text": "No", "reply_to": 999999}`)
+	assert.JSONEq(t, `{"type": "error", "code": "invalid_command", "message": "invalid reply_to", "command": "send_msg"}`, client.Read(t))
+	assert.Len(t, mockCourier.Calls, 8)
+
+	// courier lets us know the ticket has been assigned
+	req, _ = http.NewRequest("POST", "http://localhost:8071/wc/event/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", strings.NewReader(fmt.Sprintf(`{"chat_id": "itlu4O6ZE4ZZc07Y5rHxcLoQ", "secret": "sesame", "event": {"uuid": "0191a4e4-c0a1-7d55-8a9b-0c2d1e3f4a5b", "type": "ticket_assigned", "assignee_id": %d}}`, leahID)))
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, trace.Response.StatusCode)
+	assert.Equal(t, `{"status":"queued"}`, string(trace.ResponseBody))
+
+	assert.Regexp(t, fmt.Sprintf(`^{"type":"ticket_assigned","event_uuid":"0191a4e4-c0a1-7d55-8a9b-0c2d1e3f4a5b","assignee":{"id":%d,"email":"leah@nyaruka.com","name":"Leah Tickets"},"time":"[^"]+"}$`, leahID), client.Read(t))
+
+	client.Send(t, `{"type": "ack_chat", "event_uuid": "0191a4e4-c0a1-7d55-8a9b-0c2d1e3f4a5b"}`)
+
+	// try to send an event type we don't support
+	req, _ = http.NewRequest("POST", "http://localhost:8071/wc/event/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", strings.NewReader(`{"chat_id": "itlu4O6ZE4ZZc07Y5rHxcLoQ", "secret": "sesame", "event": {"uuid": "0191a4e4-d2b3-7c44-9a8b-1d2e3f4a5b6c", "type": "flow_started"}}`))
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, trace.Response.StatusCode)
+	assert.Equal(t, `{"error":"unsupported event type: flow_started"}`, string(trace.ResponseBody))
+
+	// client sets the contact's name and language which are passed on to courier
+	client.Send(t, `{"type": "set_name", "name": "Bob"}`)
+	client.Send(t, `{"type": "set_language", "language": "spa"}`)
+
+	assert.Equal(t, `UpdateContact(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, {"name":"Bob"})`, mockCourier.Calls[8])
+	assert.Equal(t, `UpdateContact(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, {"language":"spa"})`, mockCourier.Calls[9])
+
+	// but the channel doesn't allow other fields to be set
+	client.Send(t, `{"type": "set_fields", "fields": {"age": "32"}}`)
+	assert.Len(t, mockCourier.Calls, 10)
+	assert.JSONEq(t, `{"type": "error", "code": "field_not_allowed", "message": "field not allowed: age", "command": "set_fields"}`, client.Read(t))
+
+	// try to upload a file type that isn't allowed
+	trace = uploadFile(t, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", "itlu4O6ZE4ZZc07Y5rHxcLoQ", token, "notes.txt", []byte("hello"))
+	assert.Equal(t, 415, trace.Response.StatusCode)
+	assert.Equal(t, `{"error":"file type text/plain not allowed"}`, string(trace.ResponseBody))
+
+	// or an SVG which isn't matched by image/* because it can contain scripts
+	trace = uploadFile(t, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", "itlu4O6ZE4ZZc07Y5rHxcLoQ", token, "logo.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`))
+	assert.Equal(t, 415, trace.Response.StatusCode)
+	assert.Equal(t, `{"error":"file type image/svg+xml not allowed"}`, string(trace.ResponseBody))
+
+	// try to upload for a different chat with this chat's token
+	trace = uploadFile(t, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", "A0UGLTWLLs59CrFzj6VpvMlG", token, "screenshot.png", []byte("\x89PNG\r\n\x1a\n..."))
+	assert.Equal(t, 403, trace.Response.StatusCode)
+	assert.Equal(t, `{"error":"invalid session token"}`, string(trace.ResponseBody))
+
+	// try to revoke the session with incorrect secret
+	req, _ = http.NewRequest("POST", "http://localhost:8071/wc/revoke/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", strings.NewReader(`{"chat_id": "itlu4O6ZE4ZZc07Y5rHxcLoQ", "secret": "xyz"}`))
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, trace.Response.StatusCode)
+	assert.Equal(t, `{"error":"channel secret incorrect"}`, string(trace.ResponseBody))
+
+	// revoke the session for real
+	req, _ = http.NewRequest("POST", "http://localhost:8071/wc/revoke/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", strings.NewReader(`{"chat_id": "itlu4O6ZE4ZZc07Y5rHxcLoQ", "secret": "sesame"}`))
+	trace, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, trace.Response.StatusCode)
+	assert.Equal(t, `{"status":"revoked"}`, string(trace.ResponseBody))
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	assertvk.ZGetAll(t, rc, "chat:session:itlu4O6ZE4ZZc07Y5rHxcLoQ@8291264a-4581-4d12-96e5-e9fcfa6e68d9", map[string]float64{"revoked": 0})
+
+	// and the client can no longer read history
+	client.Send(t, `{"type": "get_history"}`)
+	assert.JSONEq(t, `{"type": "error", "code": "invalid_token", "message": "invalid session token", "command": "get_history"}`, client.Read(t))
+
+	client.Close(t)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestMultipleClients(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.ResetDB()
+	defer testsuite.ResetValkey()
+
+	defer random.SetGenerator(random.DefaultGenerator)
+	random.SetGenerator(random.NewSeededGenerator(1234))
+
+	mockCourier := testsuite.NewMockCourier(rt)
+
+	svc := chip.NewService(rt, mockCourier, testsuite.NewMockMailer(), testsuite.Attachments(rt))
+	assert.NoError(t, svc.Start())
+
+	defer svc.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame"})
+	ch, err := models.LoadChannel(ctx, rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9")
+	require.NoError(t, err)
+
+	// contact starts a chat in one tab...
+	client1 := testsuite.NewClient(t, "ws://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/")
+	client1.Send(t, `{"type": "start_chat"}`)
+	event, token1 := readWithToken(t, client1)
+	assert.JSONEq(t, fmt.Sprintf(`{"type":"chat_started","chat_id":"itlu4O6ZE4ZZc07Y5rHxcLoQ","token":"%s","online":true}`, token1), event)
+
+	// and resumes it in another
+	client2 := testsuite.NewClient(t, "ws://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/")
+	client2.Send(t, fmt.Sprintf(`{"type": "start_chat", "chat_id": "itlu4O6ZE4ZZc07Y5rHxcLoQ", "token": "%s"}`, token1))
+	event, token2 := readWithToken(t, client2)
+	assert.JSONEq(t, fmt.Sprintf(`{"type":"chat_resumed","chat_id":"itlu4O6ZE4ZZc07Y5rHxcLoQ","email":"","token":"%s","online":true}`, token2), event)
+	assert.NotEqual(t, token1, token2)
+
+	// which retires the token it was resumed with
+	assert.ErrorIs(t, svc.ValidateSession(ctx, ch, "itlu4O6ZE4ZZc07Y5rHxcLoQ", token1), sessions.ErrInvalidToken)
+	assert.NoError(t, svc.ValidateSession(ctx, ch, "itlu4O6ZE4ZZc07Y5rHxcLoQ", token2))
+
+	// but the first tab can still read history because its session was validated when it started the chat
+	client1.Send(t, `{"type": "get_history"}`)
+	assert.Regexp(t, `^{"type":"history"`, client1.Read(t))
+
+	contact, err := models.LoadContact(ctx, rt, orgID, "itlu4O6ZE4ZZc07Y5rHxcLoQ")
+	require.NoError(t, err)
+
+	// outgoing messages are sent to both clients
+	err = svc.QueueMsgOut(ctx, ch, contact, models.NewMsgOut(123, "welcome", nil, models.MsgOriginBroadcast, nil, time.Date(2024, 5, 2, 16, 5, 4, 0, time.UTC)))
+	assert.NoError(t, err)
+
+	assert.JSONEq(t, `{"type": "chat_out", "msg_out": {"id": 123, "text": "welcome", "origin": "broadcast", "time": "2024-05-02T16:05:04Z"}}`, client1.Read(t))
+	assert.JSONEq(t, `{"type": "chat_out", "msg_out": {"id": 123, "text": "welcome", "origin": "broadcast", "time": "2024-05-02T16:05:04Z"}}`, client2.Read(t))
+
+	// opening a third tab before the message is acknowledged doesn't send it again to the others
+	client3 := testsuite.NewClient(t, "ws://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/")
+	client3.Send(t, fmt.Sprintf(`{"type": "start_chat", "chat_id": "itlu4O6ZE4ZZc07Y5rHxcLoQ", "token": "%s"}`, token2))
+	event, _ = readWithToken(t, client3)
+	assert.Regexp(t, `^{"type":"chat_resumed"`, event)
+	client3.Close(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// only the first acknowledgement is reported as delivery
+	client2.Send(t, `{"type": "ack_chat", "msg_id": 123}`)
+	client1.Send(t, `{"type": "ack_chat", "msg_id": 123}`)
+
+	assert.Equal(t, []string{
+		"StartChat(8291264a-4581-4d12-96e5-e9fcfa6e68d9, itlu4O6ZE4ZZc07Y5rHxcLoQ)",
+		"ReportStatus(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, [123], delivered)",
+	}, mockCourier.Calls)
+
+	// another instance also has a tab open for this chat
+	var otherReceived []*pubsub.Message
+	var otherMutex sync.Mutex
+
+	other := &queue.Outboxes{KeyBase: "chat", InstanceID: "other"}
+	listener := pubsub.NewListener(rt.RP, other.NotifyChannel(), func(m *pubsub.Message) {
+		otherMutex.Lock()
+		otherReceived = append(otherReceived, m)
+		otherMutex.Unlock()
+	})
+	listener.Start()
+	defer listener.Stop()
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	_, err = rc.Do("SADD", "chat:instances:itlu4O6ZE4ZZc07Y5rHxcLoQ@8291264a-4581-4d12-96e5-e9fcfa6e68d9", "other")
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// messages sent from one tab are sent to all of them
+	client1.Send(t, `{"type": "send_msg", "text": "hello"}`)
+
+	assert.Regexp(t, `^{"type":"msg_in_created","msg_id":\d+,"time":"[^"]+"}$`, client1.Read(t))
+	assert.Regexp(t, `^{"type":"chat_in","msg_in":{"id":\d+,"text":"hello","time":"[^"]+"}}$`, client1.Read(t))
+	assert.Regexp(t, `^{"type":"chat_in","msg_in":{"id":\d+,"text":"hello","time":"[^"]+"}}$`, client2.Read(t))
+
+	otherMutex.Lock()
+	if assert.Len(t, otherReceived, 1) {
+		assert.Equal(t, pubsub.MessageTypeChatIn, otherReceived[0].Type)
+		assert.Equal(t, "hello", otherReceived[0].MsgIn.Text)
+	}
+	otherMutex.Unlock()
+
+	_, err = rc.Do("SREM", "chat:instances:itlu4O6ZE4ZZc07Y5rHxcLoQ@8291264a-4581-4d12-96e5-e9fcfa6e68d9", "other")
+	require.NoError(t, err)
+
+	// closing one tab shouldn't stop messages being sent to the other
+	client1.Close(t)
+	time.Sleep(100 * time.Millisecond)
+
+	err = svc.QueueMsgOut(ctx, ch, contact, models.NewMsgOut(124, "still there?", nil, models.MsgOriginChat, nil, time.Date(2024, 5, 2, 16, 6, 4, 0, time.UTC)))
+	assert.NoError(t, err)
+
+	assert.JSONEq(t, `{"type": "chat_out", "msg_out": {"id": 124, "text": "still there?", "origin": "chat", "time": "2024-05-02T16:06:04Z"}}`, client2.Read(t))
+
+	client2.Close(t)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestRateLimits(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetDB()
+	defer testsuite.ResetValkey()
+
+	mockCourier := testsuite.NewMockCourier(rt)
+
+	svc := chip.NewService(rt, mockCourier, testsuite.NewMockMailer(), testsuite.Attachments(rt))
+	assert.NoError(t, svc.Start())
+
+	defer svc.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame", "rate_limit_socket": "2/1h", "rate_limit_socket.start_chat": "1/1h", "rate_limit_ip": "3/1h"})
+
+	client := testsuite.NewClient(t, "ws://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/")
+	client.Send(t, `{"type": "start_chat"}`)
+	readWithToken(t, client)
+
+	// starting the chat doesn't use up the socket's limit on messages
+	client.Send(t, `{"type": "send_msg", "text": "one"}`)
+	client.Send(t, `{"type": "send_msg", "text": "two"}`)
+	for range 4 {
+		client.Read(t) // msg_in_created and chat_in events
+	}
+
+	// third message in the hour is over the socket limit so isn't created
+	client.Send(t, `{"type": "send_msg", "text": "three"}`)
+
+	assert.JSONEq(t, `{"type": "error", "code": "rate_limited", "message": "too many requests, try again later", "command": "send_msg"}`, client.Read(t))
+	assert.Len(t, mockCourier.Calls, 3)
+
+	// and chat starts have their own tighter limit
+	client.Send(t, `{"type": "start_chat"}`)
+
+	assert.JSONEq(t, `{"type": "error", "code": "rate_limited", "message": "too many requests, try again later", "command": "start_chat"}`, client.Read(t))
+
+	client.Close(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// connects are limited per IP, so after another two attempts, this IP can't connect again
+	for _, status := range []int{400, 400, 429} {
+		req, _ := http.NewRequest("POST", "http://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", nil)
+		trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+		assert.NoError(t, err)
+		assert.Equal(t, status, trace.Response.StatusCode)
+	}
+
+	// and proxy headers are ignored as it's not a trusted proxy
+	req, _ := http.NewRequest("POST", "http://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", nil)
+	req.Header.Set("X-Real-IP", "203.0.113.5")
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 429, trace.Response.StatusCode)
+
+	// uploads are limited separately
+	for _, status := range []int{400, 400, 400, 429} {
+		req, _ := http.NewRequest("POST", "http://localhost:8071/wc/upload/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", nil)
+		trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+		assert.NoError(t, err)
+		assert.Equal(t, status, trace.Response.StatusCode)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	_, rt := testsuite.Runtime()
+	rt.Config.TrustedProxies = "127.0.0.1, 10.0.0.0/8"
+
+	defer testsuite.ResetDB()
+	defer testsuite.ResetValkey()
+
+	svc := chip.NewService(rt, testsuite.NewMockCourier(rt), testsuite.NewMockMailer(), testsuite.Attachments(rt))
+	assert.NoError(t, svc.Start())
+
+	defer svc.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame", "rate_limit_ip": "2/1h"})
+
+	connect := func(headers map[string]string) int {
+		req, _ := http.NewRequest("POST", "http://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+		require.NoError(t, err)
+		return trace.Response.StatusCode
+	}
+
+	// client is the last address added before our trusted proxies, so anything it adds itself is ignored
+	assert.Equal(t, 400, connect(map[string]string{"X-Forwarded-For": "203.0.113.5, 198.51.100.7, 10.1.2.3"}))
+	assert.Equal(t, 400, connect(map[string]string{"X-Forwarded-For": "192.0.2.1, 198.51.100.7, 10.1.2.3"}))
+	assert.Equal(t, 429, connect(map[string]string{"X-Forwarded-For": "192.0.2.2, 198.51.100.7"}))
+
+	// but a different client behind the proxy has its own limit
+	assert.Equal(t, 400, connect(map[string]string{"X-Forwarded-For": "203.0.113.5"}))
+
+	// X-Real-IP set by a trusted proxy is used as is
+	assert.Equal(t, 400, connect(map[string]string{"X-Real-IP": "203.0.113.6"}))
+	assert.Equal(t, 400, connect(map[string]string{"X-Real-IP": "203.0.113.6"}))
+	assert.Equal(t, 429, connect(map[string]string{"X-Real-IP": "203.0.113.6"}))
+}
+
+func TestAvailability(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetDB()
+	defer testsuite.ResetValkey()
+
+	mockCourier := testsuite.NewMockCourier(rt)
+
+	svc := chip.NewService(rt, mockCourier, testsuite.NewMockMailer(), testsuite.Attachments(rt))
+	assert.NoError(t, svc.Start())
+
+	defer svc.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// create a channel whose schedule has no open hours so is always offline
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame", "schedule": map[string]any{"timezone": "Africa/Kigali", "hours": map[string]any{}}})
+
+	client := testsuite.NewClient(t, "ws://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/")
+	client.Send(t, `{"type": "start_chat"}`)
+
+	event, token := readWithToken(t, client)
+	assert.JSONEq(t, fmt.Sprintf(`{"type":"chat_started","chat_id":"itlu4O6ZE4ZZc07Y5rHxcLoQ","token":"%s","online":false}`, token), event)
+
+	// messages sent by the contact are flagged to courier as out of hours
+	client.Send(t, `{"type": "send_msg", "text": "anyone there?"}`)
+	client.Read(t)
+
+	assert.Equal(t, "CreateMsg(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, 'anyone there?', [], out of hours)", mockCourier.Calls[1])
 
 	client.Close(t)
 	time.Sleep(100 * time.Millisecond)
 }
+
+func TestLeaveMessage(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.ResetDB()
+	defer testsuite.ResetValkey()
+
+	mockCourier := testsuite.NewMockCourier(rt)
+
+	svc := chip.NewService(rt, mockCourier, testsuite.NewMockMailer(), testsuite.Attachments(rt))
+	assert.NoError(t, svc.Start())
+
+	defer svc.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	orgID := testsuite.InsertOrg(rt, "Nyaruka")
+	testsuite.InsertChannel(rt, "8291264a-4581-4d12-96e5-e9fcfa6e68d9", orgID, "CHP", "WebChat", "123", []string{"webchat"}, map[string]any{"secret": "sesame", "schedule": map[string]any{"timezone": "Africa/Kigali", "hours": map[string]any{}}})
+
+	client := testsuite.NewClient(t, "ws://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/")
+	client.Send(t, `{"type": "leave_message", "name": "Ann", "email": "ann", "text": "Please call me back"}`)
+	assert.JSONEq(t, `{"type": "error", "code": "invalid_command", "message": "Key: 'LeaveMessage.Email' Error:Field validation for 'Email' failed on the 'email' tag", "command": "leave_message"}`, client.Read(t))
+
+	// if courier fails after the chat is started, the visitor is told to try again
+	mockCourier.CreateMsgErr = errors.New("boom")
+
+	client.Send(t, `{"type": "leave_message", "id": "c1", "name": "Ann", "email": "ann@nyaruka.com", "text": "Please call me back"}`)
+	assert.JSONEq(t, `{"type": "error", "code": "server_error", "message": "unable to handle command, try again later", "command": "leave_message", "command_id": "c1"}`, client.Read(t))
+	assert.Equal(t, []string{
+		"StartChat(8291264a-4581-4d12-96e5-e9fcfa6e68d9, itlu4O6ZE4ZZc07Y5rHxcLoQ)",
+		`UpdateContact(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, {"name":"Ann"})`,
+	}, mockCourier.Calls)
+
+	// and retrying the command carries on with the chat that was started rather than starting another
+	mockCourier.CreateMsgErr = nil
+
+	client.Send(t, `{"type": "leave_message", "id": "c1", "name": "Ann", "email": "ann@nyaruka.com", "text": "Please call me back"}`)
+
+	event, token := readWithToken(t, client)
+	assert.Regexp(t, `^{"type":"message_left","command_id":"c1","chat_id":"itlu4O6ZE4ZZc07Y5rHxcLoQ","token":"[^"]+","msg_id":\d+,"time":"[^"]+"}$`, event)
+	assert.Equal(t, []string{
+		"StartChat(8291264a-4581-4d12-96e5-e9fcfa6e68d9, itlu4O6ZE4ZZc07Y5rHxcLoQ)",
+		`UpdateContact(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, {"name":"Ann"})`,
+		`UpdateContact(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, {"name":"Ann"})`,
+		"CreateMsg(8291264a-4581-4d12-96e5-e9fcfa6e68d9, 1, 'Please call me back', [], out of hours, open ticket)",
+	}, mockCourier.Calls)
+
+	// which starts a chat so they can't then start another one
+	client.Send(t, `{"type": "start_chat"}`)
+	assert.JSONEq(t, `{"type": "error", "code": "chat_already_started", "message": "chat already started", "command": "start_chat"}`, client.Read(t))
+
+	// retrying the command again gets the same response without the message being left again
+	client.Send(t, `{"type": "leave_message", "id": "c1", "name": "Ann", "email": "ann@nyaruka.com", "text": "Please call me back"}`)
+	assert.JSONEq(t, event, client.Read(t))
+	assert.Len(t, mockCourier.Calls, 4)
+
+	// but the same command from another connection is a different command, so it can't be replayed to get the token
+	client2 := testsuite.NewClient(t, "ws://localhost:8071/wc/connect/8291264a-4581-4d12-96e5-e9fcfa6e68d9/")
+	client2.Send(t, `{"type": "leave_message", "id": "c1", "name": "Ann", "email": "ann@nyaruka.com", "text": "Please call me back"}`)
+
+	event2, token2 := readWithToken(t, client2)
+	assert.Regexp(t, `^{"type":"message_left","command_id":"c1","chat_id":"\w{24}","token":"[^"]+","msg_id":\d+,"time":"[^"]+"}$`, event2)
+	assert.NotContains(t, event2, "itlu4O6ZE4ZZc07Y5rHxcLoQ")
+	assert.NotEqual(t, token, token2)
+	assert.Len(t, mockCourier.Calls, 7)
+
+	client.Close(t)
+	client2.Close(t)
+	time.Sleep(100 * time.Millisecond)
+}
+
+// reads an event which includes a session token, returning the event and the token
+func readWithToken(t *testing.T, client *testsuite.Client) (string, string) {
+	event := client.Read(t)
+	v := &struct {
+		Token string `json:"token"`
+	}{}
+	jsonx.MustUnmarshal([]byte(event), v)
+	require.NotEmpty(t, v.Token)
+
+	return event, v.Token
+}
+
+func uploadFile(t *testing.T, channelUUID models.ChannelUUID, chatID models.ChatID, token, filename string, content []byte) *httpx.Trace {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	w.WriteField("chat_id", string(chatID))
+	w.WriteField("token", token)
+	fw, err := w.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	fw.Write(content)
+	w.Close()
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("http://localhost:8071/wc/upload/%s/", channelUUID), body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	require.NoError(t, err)
+	return trace
+}